@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"file_storage_server/server"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type AuditEntryInfo struct {
+	ID        int       `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	FileID    int       `json:"file_id"`
+	Name      string    `json:"name"`
+	OldHash   string    `json:"old_hash"`
+	NewHash   string    `json:"new_hash"`
+	ClientIP  string    `json:"client_ip"`
+	RequestID string    `json:"request_id"`
+}
+
+// parseAuditFilter reads the filters of /audit from the query string
+func parseAuditFilter(r *http.Request) (server.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := server.AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Name:   query.Get("name"),
+	}
+	switch filter.Action {
+	case "", server.ActionCreate, server.ActionUpdate, server.ActionDelete, server.ActionRestore, server.ActionPurge:
+	default:
+		return filter, fmt.Errorf("Invalid 'action' parameter. Use '%s', '%s', '%s', '%s' or '%s'.",
+			server.ActionCreate, server.ActionUpdate, server.ActionDelete, server.ActionRestore, server.ActionPurge)
+	}
+
+	var err error
+	if value := query.Get("file_id"); value != "" {
+		if filter.FileID, err = strconv.Atoi(value); err != nil || filter.FileID <= 0 {
+			return filter, fmt.Errorf("Invalid 'file_id' parameter")
+		}
+	}
+	times := []struct {
+		key    string
+		target *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}}
+	for _, t := range times {
+		if value := query.Get(t.key); value != "" {
+			if *t.target, err = time.Parse(time.RFC3339, value); err != nil {
+				return filter, fmt.Errorf("Invalid '%s' parameter, use a time like 2024-05-02T10:00:00Z", t.key)
+			}
+		}
+	}
+
+	if filter.Limit, err = parseNonNegativeInt(r, "limit", defaultAuditLimit); err != nil {
+		return filter, err
+	}
+	if filter.Limit == 0 || filter.Limit > maxAuditLimit {
+		return filter, fmt.Errorf("Invalid 'limit' parameter, it must be between 1 and %d", maxAuditLimit)
+	}
+	if filter.Offset, err = parseNonNegativeInt(r, "offset", 0); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// List the changes made to stored files, newest first
+func getAudit(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := server.GetAuditEntries(db, filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching the audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	infos := []AuditEntryInfo{}
+	for _, entry := range entries {
+		infos = append(infos, AuditEntryInfo{
+			ID:        entry.ID,
+			Time:      entry.CreatedAt,
+			Actor:     entry.Actor,
+			Action:    entry.Action,
+			FileID:    entry.FileID,
+			Name:      entry.FileName,
+			OldHash:   entry.OldHash,
+			NewHash:   entry.NewHash,
+			ClientIP:  entry.ClientIP,
+			RequestID: entry.RequestID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
@@ -0,0 +1,1142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"file_storage_server/storeclient"
+)
+
+const defaultServerURL = "http://localhost:2021"
+
+// Exit codes of the store command
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	// exitInterrupted is the status of a command stopped with Ctrl-C, as
+	// for processes killed by SIGINT
+	exitInterrupted = 130
+)
+
+// usageError is returned by commands called with invalid arguments
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func usageErrorf(format string, args ...any) error {
+	return usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+type command struct {
+	Name    string
+	Args    string
+	Summary string
+	Run     func(c *cli, flags *flag.FlagSet, args []string) error
+}
+
+// cli runs store commands against a server. Input and output streams are
+// fields so commands can be driven from tests and from the shell.
+type cli struct {
+	baseURL string
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+
+	configPath  string
+	profileName string
+
+	// output and quiet are the defaults of the -output and -q flags of
+	// commands that print data
+	output string
+	quiet  bool
+
+	client *storeclient.Client
+	// ctx is the context of the running command, canceled with Ctrl-C
+	ctx context.Context
+
+	// names caches the stored file names for completion in the shell
+	names         []string
+	namesListedAt time.Time
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"add", "[-r] [-name name] [-parallel n] <file|dir|glob>...", "Upload new files, stored under their base names. Use - to read a single file from stdin.", runAdd},
+		{"update", "[-r] [-name name] [-parallel n] <file|dir|glob>...", "Upload files, replacing the stored files with the same base names. Use - to read from stdin.", runUpdate},
+		{"rm", "[-r] [-y] [-dry-run] <file|name|glob>...", "Move stored files to the trash by name or glob, or by the content of local files. Stored names have no directories.", runRm},
+		{"ls", "[-json] [-output format] [-q]", "List stored files.", runLs},
+		{"wc", "[-output format] [-q]", "Count the words in all stored files.", runWc},
+		{"freq-words", "[-n limit] [-order asc|desc] [-output format] [-q]", "Show the most or least frequent words.", runFreqWords},
+		{"grep", "[-i] [-C n] [-A n] [-B n] [-m n] [-timeout d] [-include glob] <pattern> [file...]", "Search stored files with a regular expression.", runGrep},
+		{"stats", "[-json] [-output format] [-q] [file...]", "Show text statistics per file and in total.", runStats},
+		{"diff", "[-w] [-C n] <file>[@revision] <file>[@revision]", "Compare two stored files or revisions.", runDiff},
+		{"history", "[-json] [-output format] [-q] <name>", "List the revisions of a stored file.", runHistory},
+		{"trash", "ls [-output format] [-q] | restore <name>... | empty [-y] [name...]", "List, restore or purge deleted files.", runTrash},
+		{"audit", "[-actor user] [-action create|update|delete|restore|purge] [-name name] [-since time] [-until time] [-n limit] [-output format] [-q]", "Show who changed stored files and when.", runAudit},
+		{"patch", "[-base hash] <name> <diff-file>", "Apply a unified diff to a stored file. Use - to read the diff from stdin.", runPatch},
+		{"append", "<name> <file>", "Append a local file to a stored file. Use - to read from stdin.", runAppend},
+		{"get", "[-o dir] [-parallel n] <name>...", "Download stored files.", runGet},
+		{"sync", "[-delete] [-dry-run] [-two-way] [-parallel n] [-ignore pattern] <dir>", "Upload new and changed files of a directory, or sync both ways.", runSync},
+		{"watch", "[-debounce d] [-retries n] [-keep-remote] [-ignore pattern] <dir>", "Push changes of a directory to the server as files are saved.", runWatch},
+		{"ping", "", "Check that the server is up.", runPing},
+		{"status", "[-output format] [-q]", "Check that the server and its database are ready.", runStatus},
+		{"config", "get [key] | set <key> <value> | use <profile> | profiles", "Show or change the settings of the selected profile.", runConfig},
+		{"shell", "", "Start an interactive shell.", runShellCommand},
+		{"help", "[command]", "Show help for a command.", runHelp},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].Name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// run executes one command and returns the process exit code
+func (c *cli) run(args []string) int {
+	if len(args) == 0 {
+		c.printUsage(c.stderr)
+		return exitUsage
+	}
+	if args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		c.printUsage(c.stdout)
+		return exitOK
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(c.stderr, "store: unknown command %q\n", args[0])
+		fmt.Fprintln(c.stderr, "Run 'store help' for usage.")
+		return exitUsage
+	}
+
+	// Ctrl-C cancels the requests of the command instead of killing the
+	// process. The shell is left out, it runs every line as a command and
+	// reads lines with Ctrl-C handled by the terminal.
+	ctx := context.Background()
+	if cmd.Name != "shell" {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+	}
+	previous := c.ctx
+	c.ctx = ctx
+	defer func() { c.ctx = previous }()
+
+	flags := c.newFlagSet(cmd)
+	err := cmd.Run(c, flags, args[1:])
+
+	var usage usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case ctx.Err() != nil && errors.Is(err, context.Canceled):
+		fmt.Fprintf(c.stderr, "store %s: interrupted\n", cmd.Name)
+		return exitInterrupted
+	case errors.As(err, &usage):
+		fmt.Fprintf(c.stderr, "store %s: %v\n", cmd.Name, err)
+		fmt.Fprintf(c.stderr, "usage: store %s %s\n", cmd.Name, cmd.Args)
+		return exitUsage
+	default:
+		fmt.Fprintf(c.stderr, "store %s: %v\n", cmd.Name, err)
+		return exitFailure
+	}
+}
+
+func (c *cli) newFlagSet(cmd *command) *flag.FlagSet {
+	flags := flag.NewFlagSet("store "+cmd.Name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: store %s %s\n\n%s\n", cmd.Name, cmd.Args, cmd.Summary)
+		hasFlags := false
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(flags.Output(), "\nFlags:")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+// parseFlags parses args and turns flag errors into usage errors. Flag
+// errors have already been reported by the flag package.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return usageError{msg: err.Error()}
+	}
+	return nil
+}
+
+func (c *cli) printUsage(out io.Writer) {
+	fmt.Fprintln(out, "usage: store [-server url] [-profile name] [-timeout d] [-retries n] [-cacert file] [-cert file -key file] [-output format] [-q] <command> [flags] [arguments]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-11s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintln(out, "\nRun 'store help <command>' for details about a command.")
+}
+
+func (c *cli) writeJSON(v any) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// api returns the client for the selected server
+func (c *cli) api() (*storeclient.Client, error) {
+	if c.client == nil {
+		client, err := storeclient.New(c.baseURL)
+		if err != nil {
+			return nil, err
+		}
+		c.client = client
+	}
+	return c.client, nil
+}
+
+func (c *cli) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// openInput opens a local file, or returns stdin for "-"
+func (c *cli) openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(c.stdin), nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s: %v", name, err)
+	}
+	return file, nil
+}
+
+// uploadArgs uploads the files named by args with send: globs are
+// expanded, directories are walked with recursive and "-" reads stdin,
+// stored under name. It returns the number of files uploaded.
+func (c *cli) uploadArgs(args []string, name string, recursive bool, parallel int, send func(context.Context, storeclient.Upload) error) (int, error) {
+	paths, err := expandPaths(args, recursive)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, path := range paths {
+		if path == "-" && len(paths) > 1 {
+			return 0, usageErrorf("- cannot be combined with other files")
+		}
+	}
+	if len(paths) == 1 && paths[0] == "-" {
+		if name == "" {
+			return 0, usageErrorf("-name is required when reading from stdin")
+		}
+		return 1, send(c.context(), storeclient.Upload{Name: name, Content: c.stdin})
+	}
+
+	if err := checkStoredNames(paths); err != nil {
+		return 0, err
+	}
+	// Every file is sent in its own request so that files are uploaded in
+	// parallel and one rejected file does not stop the others
+	transfers, err := uploadTransfers(paths, send)
+	if err != nil {
+		return 0, err
+	}
+	return len(transfers), runTransfers(c.context(), transfers, parallel, c.progressOutput())
+}
+
+func runAdd(c *cli, flags *flag.FlagSet, args []string) error {
+	name := flags.String("name", "", "file name to store stdin under")
+	recursive := flags.Bool("r", false, "add the files in directories and their subdirectories")
+	parallel := flags.Int("parallel", defaultParallel, "number of files to upload at the same time")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageErrorf("no files given")
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	_, err = c.uploadArgs(flags.Args(), *name, *recursive, *parallel, func(ctx context.Context, upload storeclient.Upload) error {
+		return client.Add(ctx, upload)
+	})
+	if err != nil {
+		return err
+	}
+	c.success("Files created successfully!")
+	return nil
+}
+
+func runUpdate(c *cli, flags *flag.FlagSet, args []string) error {
+	name := flags.String("name", "", "file name to store stdin under")
+	recursive := flags.Bool("r", false, "update the files in directories and their subdirectories")
+	parallel := flags.Int("parallel", defaultParallel, "number of files to upload at the same time")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageErrorf("no files given")
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	count, err := c.uploadArgs(flags.Args(), *name, *recursive, *parallel, client.Update)
+	if err != nil {
+		return err
+	}
+	if count == 1 {
+		c.success("File updated successfully!")
+	} else {
+		c.success("%d files updated successfully!", count)
+	}
+	return nil
+}
+
+// rm deletes stored files in two ways. Local files, which must exist, are
+// deleted by content like before. Any other argument is a stored name or a
+// glob matched against the stored names, e.g. 'logs-2024-*'. Globs are
+// always matched against stored names, since the shell expands the ones
+// meant for local files.
+func runRm(c *cli, flags *flag.FlagSet, args []string) error {
+	recursive := flags.Bool("r", false, "delete the content of the files in directories and their subdirectories")
+	yes := flags.Bool("y", false, "do not ask for confirmation")
+	dryRun := flags.Bool("dry-run", false, "only list the files that would be deleted")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageErrorf("no files given")
+	}
+
+	var localArgs, remoteArgs []string
+	for _, arg := range flags.Args() {
+		if _, err := os.Stat(arg); err == nil && !hasGlobMeta(arg) {
+			localArgs = append(localArgs, arg)
+		} else {
+			remoteArgs = append(remoteArgs, arg)
+		}
+	}
+	paths, err := expandPaths(localArgs, *recursive)
+	if err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	confirm := false
+	if len(remoteArgs) > 0 {
+		files, err := client.List(c.context())
+		if err != nil {
+			return err
+		}
+		stored := make([]string, 0, len(files))
+		for _, file := range files {
+			stored = append(stored, file.Name)
+		}
+
+		seen := map[string]bool{}
+		for _, arg := range remoteArgs {
+			matches, err := matchRemote(stored, arg)
+			if err != nil {
+				return err
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("no stored file matches %q", arg)
+			}
+			confirm = confirm || hasGlobMeta(arg)
+			for _, match := range matches {
+				if !seen[match] {
+					seen[match] = true
+					names = append(names, match)
+				}
+			}
+		}
+	}
+
+	if *dryRun || (confirm && !*yes) {
+		fmt.Fprintf(c.stdout, "The following %d stored files will be deleted:\n", len(names))
+		for _, name := range names {
+			fmt.Fprintf(c.stdout, "  %s\n", name)
+		}
+		for _, path := range paths {
+			fmt.Fprintf(c.stdout, "  %s (by content)\n", path)
+		}
+		if *dryRun {
+			return nil
+		}
+		ok, err := c.confirm(fmt.Sprintf("Delete %d files?", len(names)+len(paths)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("aborted, no files were deleted")
+		}
+	}
+
+	var errs []error
+	for _, name := range names {
+		if err := client.DeleteByName(c.context(), name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if len(paths) > 0 {
+		transfers, err := uploadTransfers(paths, client.Delete)
+		if err != nil {
+			return err
+		}
+		errs = append(errs, runTransfers(c.context(), transfers, defaultParallel, nil))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if count := len(names) + len(paths); count == 1 {
+		c.success("File successfully deleted!")
+	} else {
+		c.success("%d files successfully deleted!", count)
+	}
+	return nil
+}
+
+// confirm asks a yes or no question on stdin. Anything but y or yes,
+// including the end of input, is no.
+func (c *cli) confirm(question string) (bool, error) {
+	fmt.Fprintf(c.stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(c.stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+func runLs(c *cli, flags *flag.FlagSet, args []string) error {
+	output := c.outputFlags(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("unexpected arguments")
+	}
+	if err := output.check(); err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	files, err := client.List(c.context())
+	if err != nil {
+		return err
+	}
+
+	r := result{
+		Value:  files,
+		Header: []string{"id", "name", "hash_digest", "bytes", "created_at", "updated_at"},
+		Table: func(w io.Writer) {
+			for _, file := range files {
+				fmt.Fprintf(w, "File ID: %d, Name: %s\n", file.ID, file.Name)
+			}
+		},
+	}
+	for _, file := range files {
+		r.Rows = append(r.Rows, []string{strconv.Itoa(file.ID), file.Name, file.HashDigest,
+			strconv.Itoa(file.Bytes), formatTime(file.CreatedAt), formatTime(file.UpdatedAt)})
+		r.IDs = append(r.IDs, strconv.Itoa(file.ID))
+	}
+	return c.print(output, r)
+}
+
+func runWc(c *cli, flags *flag.FlagSet, args []string) error {
+	output := c.outputFlags(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := output.check(); err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	count, err := client.WordCount(c.context())
+	if err != nil {
+		return err
+	}
+	return c.print(output, result{
+		Value:  map[string]int{"words": count},
+		Header: []string{"words"},
+		Rows:   [][]string{{strconv.Itoa(count)}},
+		IDs:    []string{strconv.Itoa(count)},
+		Table: func(w io.Writer) {
+			fmt.Fprintf(w, "All files contain %d words\n", count)
+		},
+	})
+}
+
+func runFreqWords(c *cli, flags *flag.FlagSet, args []string) error {
+	limit := flags.Int("n", 5, "number of words to show")
+	flags.IntVar(limit, "limit", 5, "alias for -n")
+	offset := flags.Int("offset", 0, "number of ranked words to skip")
+	order := flags.String("order", "desc", "asc for the least frequent words, desc for the most frequent")
+	output := c.outputFlags(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *order != "asc" && *order != "desc" && *order != "dsc" {
+		return usageErrorf("invalid order %q, use asc or desc", *order)
+	}
+	if err := output.check(); err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	words, err := client.FrequentWords(c.context(), storeclient.FrequentWordsOptions{
+		Limit:     *limit,
+		Offset:    *offset,
+		Ascending: *order == "asc",
+	})
+	if err != nil {
+		return err
+	}
+
+	ordering := "most"
+	if *order == "asc" {
+		ordering = "least"
+	}
+	r := result{
+		Value:  words,
+		Header: []string{"word", "count"},
+		Table: func(w io.Writer) {
+			fmt.Fprintf(w, "The %d %s frequent words are:\n", len(words), ordering)
+			for _, word := range words {
+				fmt.Fprintf(w, "%s %d\n", word.Word, word.Count)
+			}
+		},
+	}
+	for _, word := range words {
+		r.Rows = append(r.Rows, []string{word.Word, strconv.Itoa(word.Count)})
+		r.IDs = append(r.IDs, word.Word)
+	}
+	return c.print(output, r)
+}
+
+func runGrep(c *cli, flags *flag.FlagSet, args []string) error {
+	opts, err := parseGrepArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	return client.Grep(c.context(), opts, func(line storeclient.GrepLine) error {
+		_, err := fmt.Fprintln(c.stdout, line)
+		return err
+	})
+}
+
+func runStats(c *cli, flags *flag.FlagSet, args []string) error {
+	output := c.outputFlags(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if err := output.check(); err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	stats, err := client.Stats(c.context(), flags.Args()...)
+	if err != nil {
+		return err
+	}
+
+	r := result{
+		Value: stats,
+		Header: []string{"name", "lines", "words", "characters", "bytes", "average_word_length",
+			"unique_words", "vocabulary_richness", "reading_time_seconds"},
+		Table: func(w io.Writer) { printStats(w, stats) },
+	}
+	row := func(s storeclient.TextStats, name string) {
+		r.Rows = append(r.Rows, []string{name, strconv.Itoa(s.Lines), strconv.Itoa(s.Words),
+			strconv.Itoa(s.Characters), strconv.Itoa(s.Bytes), formatFloat(s.AverageWordLength),
+			strconv.Itoa(s.UniqueWords), formatFloat(s.VocabularyRichness), strconv.Itoa(s.ReadingTimeSeconds)})
+	}
+	for _, s := range stats.Files {
+		row(s, s.Name)
+		r.IDs = append(r.IDs, s.Name)
+	}
+	// The total is the last row, with an empty name
+	row(stats.Total, "")
+	return c.print(output, r)
+}
+
+func runDiff(c *cli, flags *flag.FlagSet, args []string) error {
+	wordMode := flags.Bool("w", false, "word level diff")
+	context := flags.Int("C", 3, "lines of context")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return usageErrorf("expected two files")
+	}
+
+	opts := storeclient.DiffOptions{Words: *wordMode, Context: *context}
+	opts.A, opts.RevA = splitRevision(flags.Arg(0))
+	opts.B, opts.RevB = splitRevision(flags.Arg(1))
+	if *context == 0 {
+		opts.Context = -1
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	diff, err := client.Diff(c.context(), opts)
+	if err != nil {
+		return err
+	}
+
+	if useColor(c.stdout) {
+		diff = colorizeDiff(diff, *wordMode)
+	}
+	fmt.Fprint(c.stdout, diff)
+	if *wordMode && diff != "" && !strings.HasSuffix(diff, "\n") {
+		fmt.Fprintln(c.stdout)
+	}
+	return nil
+}
+
+func runHistory(c *cli, flags *flag.FlagSet, args []string) error {
+	output := c.outputFlags(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageErrorf("expected exactly one file name")
+	}
+	if err := output.check(); err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	history, err := client.History(c.context(), flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	r := result{
+		Value:  history,
+		Header: []string{"revision", "hash_digest", "bytes", "created_at"},
+		Table:  func(w io.Writer) { printHistory(w, history) },
+	}
+	for _, revision := range history {
+		r.Rows = append(r.Rows, []string{strconv.Itoa(revision.Revision), revision.HashDigest,
+			strconv.Itoa(revision.Bytes), formatTime(revision.CreatedAt)})
+		r.IDs = append(r.IDs, strconv.Itoa(revision.Revision))
+	}
+	return c.print(output, r)
+}
+
+func runAudit(c *cli, flags *flag.FlagSet, args []string) error {
+	var opts storeclient.AuditOptions
+	flags.StringVar(&opts.Actor, "actor", "", "only changes made by this user, or anonymous")
+	flags.StringVar(&opts.Action, "action", "", "only create, update, delete, restore or purge")
+	flags.StringVar(&opts.Name, "name", "", "only changes of this file")
+	since := flags.String("since", "", "only changes since a time like 2024-05-02T10:00:00Z, or a duration ago like 24h")
+	until := flags.String("until", "", "only changes before a time or a duration ago")
+	flags.IntVar(&opts.Limit, "n", 100, "number of changes to show")
+	flags.IntVar(&opts.Offset, "offset", 0, "number of newest changes to skip")
+	output := c.outputFlags(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("unexpected arguments")
+	}
+	if err := output.check(); err != nil {
+		return err
+	}
+	now := time.Now()
+	var err error
+	if opts.Since, err = parseTimeFlag(*since, now); err != nil {
+		return usageErrorf("invalid -since: %v", err)
+	}
+	if opts.Until, err = parseTimeFlag(*until, now); err != nil {
+		return usageErrorf("invalid -until: %v", err)
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	entries, err := client.Audit(c.context(), opts)
+	if err != nil {
+		return err
+	}
+
+	r := result{
+		Value:  entries,
+		Header: []string{"id", "time", "actor", "action", "file_id", "name", "old_hash", "new_hash", "client_ip", "request_id"},
+		Table:  func(w io.Writer) { printAudit(w, entries) },
+	}
+	for _, entry := range entries {
+		r.Rows = append(r.Rows, []string{strconv.Itoa(entry.ID), formatTime(entry.Time), entry.Actor, entry.Action,
+			strconv.Itoa(entry.FileID), entry.Name, entry.OldHash, entry.NewHash, entry.ClientIP, entry.RequestID})
+		r.IDs = append(r.IDs, strconv.Itoa(entry.ID))
+	}
+	return c.print(output, r)
+}
+
+// trash works on the deleted files the server keeps. ls lists them, restore
+// takes files out of the trash by name, and empty removes them for good,
+// all of them after asking for confirmation, or only the named ones.
+func runTrash(c *cli, flags *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		return usageErrorf("missing subcommand")
+	}
+
+	switch sub := args[0]; sub {
+	case "-h", "-help", "--help":
+		flags.Usage()
+		return flag.ErrHelp
+
+	case "ls":
+		output := c.outputFlags(flags)
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 0 {
+			return usageErrorf("unexpected arguments")
+		}
+		if err := output.check(); err != nil {
+			return err
+		}
+
+		client, err := c.api()
+		if err != nil {
+			return err
+		}
+		files, err := client.Trash(c.context())
+		if err != nil {
+			return err
+		}
+
+		r := result{
+			Value:  files,
+			Header: []string{"id", "name", "hash_digest", "bytes", "created_at", "deleted_at", "purge_at"},
+			Table:  func(w io.Writer) { printTrash(w, files) },
+		}
+		for _, file := range files {
+			purgeAt := ""
+			if file.PurgeAt != nil {
+				purgeAt = formatTime(*file.PurgeAt)
+			}
+			r.Rows = append(r.Rows, []string{strconv.Itoa(file.ID), file.Name, file.HashDigest, strconv.Itoa(file.Bytes),
+				formatTime(file.CreatedAt), formatTime(file.DeletedAt), purgeAt})
+			r.IDs = append(r.IDs, strconv.Itoa(file.ID))
+		}
+		return c.print(output, r)
+
+	case "restore":
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			return usageErrorf("no files given")
+		}
+		client, err := c.api()
+		if err != nil {
+			return err
+		}
+
+		var errs []error
+		for _, name := range flags.Args() {
+			if err := client.Restore(c.context(), name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+		if count := flags.NArg(); count == 1 {
+			c.success("File successfully restored!")
+		} else {
+			c.success("%d files successfully restored!", count)
+		}
+		return nil
+
+	case "empty":
+		yes := flags.Bool("y", false, "do not ask for confirmation")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		client, err := c.api()
+		if err != nil {
+			return err
+		}
+
+		if flags.NArg() == 0 && !*yes {
+			ok, err := c.confirm("Delete every file in the trash for good?")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.New("aborted, no files were deleted")
+			}
+		}
+		purged, err := client.EmptyTrash(c.context(), flags.Args()...)
+		if err != nil {
+			return err
+		}
+		if purged == 1 {
+			c.success("1 file deleted for good")
+		} else {
+			c.success("%d files deleted for good", purged)
+		}
+		return nil
+
+	default:
+		return usageErrorf("unknown subcommand %q", sub)
+	}
+}
+
+// parseTimeFlag parses a time like 2024-05-02T10:00:00Z, or a duration like
+// 24h meaning that long before now. Empty values are the zero time.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a time like 2024-05-02T10:00:00Z or a duration like 24h", value)
+	}
+	return t, nil
+}
+
+func runPatch(c *cli, flags *flag.FlagSet, args []string) error {
+	base := flags.String("base", "", "expected hash of the remote file")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return usageErrorf("expected a file name and a diff file")
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	diff, err := c.openInput(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer diff.Close()
+
+	hash, err := client.Patch(c.context(), flags.Arg(0), diff, *base)
+	if err != nil {
+		return err
+	}
+	c.printHash(hash)
+	return nil
+}
+
+func runAppend(c *cli, flags *flag.FlagSet, args []string) error {
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return usageErrorf("expected a file name and a local file")
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	data, err := c.openInput(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	hash, err := client.Append(c.context(), flags.Arg(0), data)
+	if err != nil {
+		return err
+	}
+	c.printHash(hash)
+	return nil
+}
+
+func runGet(c *cli, flags *flag.FlagSet, args []string) error {
+	dir := flags.String("o", ".", "directory to write the files to")
+	parallel := flags.Int("parallel", defaultParallel, "number of files to download at the same time")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageErrorf("no files given")
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	// The sizes of the files are needed for the progress bars
+	files, err := client.List(c.context())
+	if err != nil {
+		return err
+	}
+	sizes := map[string]int64{}
+	for _, file := range files {
+		sizes[file.Name] = int64(file.Bytes)
+	}
+
+	var transfers []transfer
+	for _, name := range flags.Args() {
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return usageErrorf("invalid file name %q", name)
+		}
+		name := name
+		transfers = append(transfers, transfer{
+			Name: name,
+			Size: sizes[name],
+			Run: func(ctx context.Context, p *transferProgress) error {
+				return writeFileAtomic(filepath.Join(*dir, name), func(w io.Writer) error {
+					_, err := client.Download(ctx, name, p.Writer(w))
+					return err
+				})
+			},
+		})
+	}
+
+	if err := runTransfers(c.context(), transfers, *parallel, c.progressOutput()); err != nil {
+		return err
+	}
+	c.success("Downloaded %d files to %s", len(transfers), *dir)
+	return nil
+}
+
+func runPing(c *cli, flags *flag.FlagSet, args []string) error {
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	if err := client.Ping(c.context()); err != nil {
+		return err
+	}
+	c.success("pong working!")
+	return nil
+}
+
+func runStatus(c *cli, flags *flag.FlagSet, args []string) error {
+	output := c.outputFlags(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return usageErrorf("unexpected arguments")
+	}
+	if err := output.check(); err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	health, err := client.Ready(c.context())
+	if err != nil {
+		return err
+	}
+
+	r := result{
+		Value:  health,
+		Header: []string{"name", "status", "error", "duration_seconds"},
+		Table: func(w io.Writer) {
+			fmt.Fprintf(w, "Server %s is %s\n", client.BaseURL(), health.Status)
+			printHealthChecks(w, health.Checks)
+		},
+	}
+	for _, check := range health.Checks {
+		r.Rows = append(r.Rows, []string{check.Name, check.Status, check.Error, formatFloat(check.DurationSeconds)})
+		if check.Status != "ok" {
+			r.IDs = append(r.IDs, check.Name)
+		}
+	}
+	if err := c.print(output, r); err != nil {
+		return err
+	}
+	if !health.Ready() {
+		return errors.New("server is not ready")
+	}
+	return nil
+}
+
+func runShellCommand(c *cli, flags *flag.FlagSet, args []string) error {
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	return c.shell()
+}
+
+func runHelp(c *cli, flags *flag.FlagSet, args []string) error {
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		c.printUsage(c.stdout)
+		return nil
+	}
+
+	cmd := findCommand(flags.Arg(0))
+	if cmd == nil {
+		return usageErrorf("unknown command %q", flags.Arg(0))
+	}
+	cmdFlags := c.newFlagSet(cmd)
+	cmdFlags.SetOutput(c.stdout)
+	// Running with -h registers the command's flags and prints its usage
+	if err := cmd.Run(c, cmdFlags, []string{"-h"}); err != nil && !errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	return nil
+}
+
+// main parses the global flags, selects the server from the configuration
+// and runs the command
+func (c *cli) main(args []string) int {
+	global := flag.NewFlagSet("store", flag.ContinueOnError)
+	global.SetOutput(c.stderr)
+	global.Usage = func() { c.printUsage(c.stderr) }
+	server := global.String("server", "", "server URL, overrides the profile and $STORE_URL")
+	global.StringVar(&c.profileName, "profile", "", "configuration profile to use")
+	configPath := global.String("config", "", "configuration file")
+	global.StringVar(&c.output, "output", outputTable, "output format of commands that print data: table, json, yaml or csv")
+	global.BoolVar(&c.quiet, "q", false, "print only IDs, and nothing when a command succeeds")
+	timeout := global.Duration("timeout", 0, "how long to wait for the server to answer, overrides the profile")
+	retries := global.Int("retries", -1, "number of times failed read requests are retried, overrides the profile")
+	caCert := global.String("cacert", "", "PEM file of CAs to trust for https servers, overrides the profile")
+	clientCert := global.String("cert", "", "client certificate file, overrides the profile")
+	clientKey := global.String("key", "", "client certificate key file, overrides the profile")
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if !validOutputFormat(c.output) {
+		fmt.Fprintf(c.stderr, "store: invalid output format %q, use table, json, yaml or csv\n", c.output)
+		return exitUsage
+	}
+
+	c.configPath = *configPath
+	if c.configPath == "" {
+		path, err := defaultConfigPath()
+		if err != nil {
+			fmt.Fprintf(c.stderr, "store: %v\n", err)
+			return exitFailure
+		}
+		c.configPath = path
+	}
+
+	cfg, err := loadConfig(c.configPath)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "store: %v\n", err)
+		return exitFailure
+	}
+
+	// The config command must work even when the selected profile is broken
+	if global.Arg(0) != "config" {
+		profile, err := cfg.resolveProfile(cfg.profileName(c.profileName), *server)
+		if err != nil {
+			fmt.Fprintf(c.stderr, "store: %v\n", err)
+			return exitUsage
+		}
+		c.baseURL = profile.URL
+		if *timeout > 0 {
+			profile.Timeout = *timeout
+		}
+		if *retries >= 0 {
+			profile.Retries = retries
+		}
+		if *caCert != "" {
+			profile.CACert = *caCert
+		}
+		if *clientCert != "" {
+			profile.ClientCert = *clientCert
+		}
+		if *clientKey != "" {
+			profile.ClientKey = *clientKey
+		}
+		c.client, err = newStoreClient(profile)
+		if err != nil {
+			fmt.Fprintf(c.stderr, "store: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	return c.run(global.Args())
+}
+
+func main() {
+	c := &cli{
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+	os.Exit(c.main(os.Args[1:]))
+}
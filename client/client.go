@@ -1,328 +1,224 @@
 package main
 
 import (
-    "bufio"
-    "bytes"
+    "flag"
     "fmt"
     "io"
-    "log"
-    "mime/multipart"
-    "net/http"
     "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
     "strings"
-)
+    "text/tabwriter"
+    "time"
 
-func pingServer(baseURL string) string {
-    serverURL := baseURL + "/ping"
+    "file_storage_server/storeclient"
+)
 
-    resp, err := http.Get(serverURL)
-    if err != nil {
-        log.Println("Error sending request:", err)
-        return ""
-    }
-    defer resp.Body.Close()
+const (
+    colorReset = "\033[0m"
+    colorRed   = "\033[31m"
+    colorGreen = "\033[32m"
+    colorCyan  = "\033[36m"
+    colorBold  = "\033[1m"
+)
 
-    if resp.StatusCode != http.StatusOK {
-        log.Printf("Error: Received non-OK response status %d\n", resp.StatusCode)
-        return ""
+// openUploads opens local files for upload. The files are stored under
+// their base name. The returned function closes every opened file.
+func openUploads(filenames []string) ([]storeclient.Upload, func(), error) {
+    var files []*os.File
+    closeAll := func() {
+        for _, file := range files {
+            file.Close()
+        }
     }
 
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        log.Println("Error reading response body:", err)
-        return ""
+    var uploads []storeclient.Upload
+    for _, filename := range filenames {
+        file, err := os.Open(filename)
+        if err != nil {
+            closeAll()
+            return nil, nil, fmt.Errorf("Error opening file '%s': %v", filename, err)
+        }
+        files = append(files, file)
+        uploads = append(uploads, storeclient.Upload{Name: filepath.Base(filename), Content: file})
     }
 
-    fmt.Printf("%s\n", string(body))
-    return string(body)
+    return uploads, closeAll, nil
 }
 
-func getFiles(baseURL string) string {
-    serverURL := baseURL + "/list"
+// printStats renders statistics as a table with one row per file and a
+// final row for the totals, in the column order of `wc -lwmc`
+func printStats(out io.Writer, stats *storeclient.Stats) {
+    tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+    fmt.Fprintln(tw, "LINES\tWORDS\tCHARS\tBYTES\tAVG WORD\tUNIQUE\tRICHNESS\tREADING\t")
 
-    resp, err := http.Get(serverURL)
-    if err != nil {
-        log.Println("Error sending request:", err)
-        return ""
+    row := func(s storeclient.TextStats, name string) {
+        fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%.2f\t%d\t%.2f\t%s\t %s\n",
+            s.Lines, s.Words, s.Characters, s.Bytes, s.AverageWordLength,
+            s.UniqueWords, s.VocabularyRichness, formatReadingTime(s.ReadingTimeSeconds), name)
     }
-    defer resp.Body.Close()
-
-    if resp.StatusCode != http.StatusOK {
-        log.Printf("Error: Received non-OK response status %d\n", resp.StatusCode)
-        return ""
+    for _, s := range stats.Files {
+        row(s, s.Name)
     }
-
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        log.Println("Error reading response body:", err)
-        return ""
-    }
-
-    fmt.Printf("%s\n", string(body))
-    return string(body)
+    row(stats.Total, "total")
+    tw.Flush()
 }
 
-func deleteFile(baseURL string, filename string) (string, error) {
-    file, err := os.Open(filename)
-    if err != nil {
-        return "", fmt.Errorf("Error opening %s: %v", filename, err)
-    }
-    defer file.Close()
-
-    var requestBody bytes.Buffer
-    writer := multipart.NewWriter(&requestBody)
-
-    part, err := writer.CreateFormFile("files", filename)
-    if err != nil {
-        return "", fmt.Errorf("Error creating form file: %v", err)
-    }
-
-    _, err = io.Copy(part, file)
-    if err != nil {
-        return "", fmt.Errorf("Error copying file content: %v", err)
-    }
-
-    err = writer.Close()
-    if err != nil {
-        return "", fmt.Errorf("Error closing writer: %v", err)
+func formatReadingTime(seconds int) string {
+    if seconds < 60 {
+        return fmt.Sprintf("%ds", seconds)
     }
+    return fmt.Sprintf("%dm%02ds", seconds/60, seconds%60)
+}
 
-    url := baseURL + "/delete"
-    req, err := http.NewRequest("DELETE", url, &requestBody)
-    if err != nil {
-        return "", fmt.Errorf("Error creating request: %v", err)
-    }
-
-    req.Header.Set("Content-Type", writer.FormDataContentType())
-
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        return "", fmt.Errorf("Error sending request: %v", err)
+// splitRevision splits "name@3" into the file name and revision number.
+// Names without a numeric @ suffix are returned unchanged with revision 0,
+// which refers to the current content.
+func splitRevision(arg string) (string, int) {
+    at := strings.LastIndex(arg, "@")
+    if at <= 0 {
+        return arg, 0
     }
-    defer resp.Body.Close()
-
-    if resp.StatusCode != http.StatusOK {
-        return "", fmt.Errorf("Error: received non-OK response: %v", resp.Status)
+    revision, err := strconv.Atoi(arg[at+1:])
+    if err != nil || revision < 1 {
+        return arg, 0
     }
-
-    fmt.Println("File successfully deleted!")
-    return "File successfully deleted!", nil
+    return arg[:at], revision
 }
 
-func putFile(baseURL string, filename string) (string, error) {
-    file, err := os.Open(filename)
-    if err != nil {
-        return "", fmt.Errorf("Error opening %s: %v", filename, err)
-    }
-    defer file.Close()
-
-    var requestBody bytes.Buffer
-    writer := multipart.NewWriter(&requestBody)
-
-    part, err := writer.CreateFormFile("files", filename)
-    if err != nil {
-        return "", fmt.Errorf("Error creating form file: %v", err)
-    }
+var (
+    wordDeletePattern = regexp.MustCompile(`(?s)\[-(.*?)-\]`)
+    wordInsertPattern = regexp.MustCompile(`(?s)\{\+(.*?)\+\}`)
+)
 
-    _, err = io.Copy(part, file)
-    if err != nil {
-        return "", fmt.Errorf("Error copying file content: %v", err)
+// colorizeDiff adds terminal colors to the output of /diff. Unified diffs
+// are colored line by line, word diffs by their [-...-] and {+...+} markers.
+func colorizeDiff(diff string, wordMode bool) string {
+    if wordMode {
+        diff = wordDeletePattern.ReplaceAllString(diff, colorRed+"[-$1-]"+colorReset)
+        return wordInsertPattern.ReplaceAllString(diff, colorGreen+"{+$1+}"+colorReset)
+    }
+
+    lines := strings.SplitAfter(diff, "\n")
+    for i, line := range lines {
+        switch {
+        case strings.HasPrefix(line, "--- "), strings.HasPrefix(line, "+++ "):
+            lines[i] = colorBold + strings.TrimSuffix(line, "\n") + colorReset + "\n"
+        case strings.HasPrefix(line, "@@"):
+            lines[i] = colorCyan + strings.TrimSuffix(line, "\n") + colorReset + "\n"
+        case strings.HasPrefix(line, "-"):
+            lines[i] = colorRed + strings.TrimSuffix(line, "\n") + colorReset + "\n"
+        case strings.HasPrefix(line, "+"):
+            lines[i] = colorGreen + strings.TrimSuffix(line, "\n") + colorReset + "\n"
+        }
     }
+    return strings.Join(lines, "")
+}
 
-    err = writer.Close()
-    if err != nil {
-        return "", fmt.Errorf("Error closing writer: %v", err)
+// useColor reports whether output written to w should contain colors
+func useColor(w io.Writer) bool {
+    if os.Getenv("NO_COLOR") != "" {
+        return false
     }
-
-    url := baseURL + "/update"
-    req, err := http.NewRequest("PUT", url, &requestBody)
-    if err != nil {
-        return "", fmt.Errorf("Error creating request: %v", err)
+    f, ok := w.(*os.File)
+    if !ok {
+        return false
     }
-
-    req.Header.Set("Content-Type", writer.FormDataContentType())
-
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    info, err := f.Stat()
     if err != nil {
-        return "", fmt.Errorf("Error sending request: %v", err)
+        return false
     }
-    defer resp.Body.Close()
+    return info.Mode()&os.ModeCharDevice != 0
+}
 
-    if resp.StatusCode != http.StatusOK {
-        return "", fmt.Errorf("Error: received non-OK response: %v", resp.Status)
+func printHistory(out io.Writer, history []storeclient.Revision) {
+    tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "REVISION\tCREATED\tBYTES\tHASH")
+    for _, revision := range history {
+        fmt.Fprintf(tw, "%d\t%s\t%d\t%s\n", revision.Revision,
+            revision.CreatedAt.Format(time.DateTime), revision.Bytes, revision.HashDigest)
     }
-
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        log.Println("Error updating the file: ", err)
-        return "", err
-    }
-
-    fmt.Printf("%s\n", string(body))
-    return string(body), nil
+    tw.Flush()
 }
 
-func postFile(baseURL string, filenames []string) (string, error) {
-    var requestBody bytes.Buffer
-    writer := multipart.NewWriter(&requestBody)
-
-    for _, filename := range filenames {
-        fmt.Println("Attempting to open file:", filename)
-
-        file, err := os.Open(filename)
-        if err != nil {
-            return "", fmt.Errorf("Error opening file '%s': %v", filename, err)
+func printTrash(out io.Writer, files []storeclient.TrashedFile) {
+    tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "NAME\tDELETED\tPURGE AT\tBYTES\tHASH")
+    for _, file := range files {
+        purgeAt := "never"
+        if file.PurgeAt != nil {
+            purgeAt = file.PurgeAt.Format(time.DateTime)
         }
-        defer file.Close()
-
-        part, err := writer.CreateFormFile("files", filename)
-        if err != nil {
-            return "", fmt.Errorf("Error creating form file for '%s': %v", filename, err)
-        }
-
-        _, err = io.Copy(part, file)
-        if err != nil {
-            return "", fmt.Errorf("Error copying file content for '%s': %v", filename, err)
-        }
-    }
-
-    err := writer.Close()
-    if err != nil {
-        return "", fmt.Errorf("Error closing writer: %v", err)
+        fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", file.Name, file.DeletedAt.Format(time.DateTime),
+            purgeAt, file.Bytes, shortHash(file.HashDigest))
     }
+    tw.Flush()
+}
 
-    url := baseURL + "/add"
-    req, err := http.NewRequest("POST", url, &requestBody)
-    if err != nil {
-        return "", fmt.Errorf("Error creating request: %v", err)
+func printAudit(out io.Writer, entries []storeclient.AuditEntry) {
+    tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "TIME\tACTOR\tACTION\tNAME\tOLD HASH\tNEW HASH\tCLIENT\tREQUEST")
+    for _, entry := range entries {
+        fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Format(time.DateTime),
+            entry.Actor, entry.Action, entry.Name, shortHash(entry.OldHash), shortHash(entry.NewHash),
+            entry.ClientIP, entry.RequestID)
     }
+    tw.Flush()
+}
 
-    req.Header.Set("Content-Type", writer.FormDataContentType())
-
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        return "", fmt.Errorf("Error sending request: %v", err)
+// shortHash shortens a hash for tables, like git does, and shows a missing
+// one as -
+func shortHash(hash string) string {
+    if hash == "" {
+        return "-"
     }
-    defer resp.Body.Close()
+    return hash[:min(len(hash), 12)]
+}
 
-    if resp.StatusCode != http.StatusOK {
-        return "", fmt.Errorf("Error: received non-OK response: %v", resp.Status)
+func printHealthChecks(out io.Writer, checks []storeclient.HealthCheck) {
+    tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "CHECK\tSTATUS\tTIME\tERROR")
+    for _, check := range checks {
+        elapsed := time.Duration(check.DurationSeconds * float64(time.Second)).Round(time.Microsecond)
+        fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", check.Name, check.Status, elapsed, check.Error)
     }
-
-    responseBody, _ := io.ReadAll(resp.Body)
-    fmt.Println("Server Response:", string(responseBody))
-
-    fmt.Println("Files created successfully!")
-    return "Files created successfully!", nil
+    tw.Flush()
 }
 
-func getWC(baseURL string) (string, error) {
-    serverURL := baseURL + "/wc"
+// parseGrepArgs turns the arguments of "store grep" into search options
+func parseGrepArgs(flags *flag.FlagSet, args []string) (storeclient.GrepOptions, error) {
+    ignoreCase := flags.Bool("i", false, "ignore case")
+    contextLines := flags.Int("C", 0, "lines of context")
+    before := flags.Int("B", -1, "lines of leading context")
+    after := flags.Int("A", -1, "lines of trailing context")
+    maxCount := flags.Int("m", 0, "stop after this many matches")
+    timeout := flags.Duration("timeout", 0, "search timeout, e.g. 5s")
+    include := flags.String("include", "", "only search files matching this glob")
 
-    resp, err := http.Get(serverURL)
-    if err != nil {
-        log.Println("Error sending request:", err)
-        return "", err
+    if err := parseFlags(flags, args); err != nil {
+        return storeclient.GrepOptions{}, err
     }
-    defer resp.Body.Close()
-
-    if resp.StatusCode != http.StatusOK {
-        log.Printf("Error: Received non-OK response status %d\n", resp.StatusCode)
-        return "", err
+    if flags.NArg() == 0 {
+        return storeclient.GrepOptions{}, usageErrorf("missing pattern")
     }
 
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        log.Println("Error reading response body:", err)
-        return "", err
+    opts := storeclient.GrepOptions{
+        Pattern:    flags.Arg(0),
+        IgnoreCase: *ignoreCase,
+        Before:     *contextLines,
+        After:      *contextLines,
+        MaxCount:   *maxCount,
+        Timeout:    *timeout,
+        Include:    *include,
+        Files:      flags.Args()[1:],
     }
-
-    fmt.Printf("%s\n", string(body))
-    return string(body), nil
-}
-
-func getFW(baseURL string, limit string, order string) (string, error) {
-    serverURL := baseURL + "/fw?limit=" + limit + "&order=" + order
-
-    resp, err := http.Get(serverURL)
-    if err != nil {
-        log.Println("Error sending request:", err)
-        return "", err
+    if *before >= 0 {
+        opts.Before = *before
     }
-    defer resp.Body.Close()
-
-    if resp.StatusCode != http.StatusOK {
-        log.Printf("Error: Received non-OK response status %d\n", resp.StatusCode)
-        return "", err
+    if *after >= 0 {
+        opts.After = *after
     }
 
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        log.Println("Error reading response body:", err)
-        return "", err
-    }
-
-    fmt.Printf("%s\n", string(body))
-    return string(body), nil
-}
-
-
-func main() {
-    baseURL := "http://localhost:2021"
-
-    fmt.Println("CLI Program started. Type 'store' to send a request to the server.")
-
-    scanner := bufio.NewScanner(os.Stdin)
-
-    for {
-        // Print to show newline in which user can put command
-        fmt.Print("> ")
-        scanner.Scan()
-
-        command := strings.TrimSpace(scanner.Text())
-
-        if strings.HasPrefix(command, "store rm ") {
-            filename := strings.TrimPrefix(command, "store rm ")
-            fmt.Printf("Sending delete request for file: %s\n", filename)
-            _, err := deleteFile(baseURL, filename)
-            if err != nil {
-                log.Printf("Error: %v\n", err)
-            }
-        } else if strings.HasPrefix(command, "store update ") {
-            filename := strings.TrimPrefix(command, "store update ")
-            fmt.Printf("Sending update request for file: %s\n", filename)
-            _, err := putFile(baseURL, filename)
-            if err != nil {
-                log.Printf("Error: %v\n", err)
-            }
-        } else if strings.HasPrefix(command, "store add") {
-            parts := strings.Fields(command)
-            filenames := parts[2:]
-            fmt.Println("Sending create request")
-            _, err := postFile(baseURL, filenames)
-            if err != nil {
-                log.Printf("Error: %v\n", err)
-            }
-        } else if command == "store wc" {
-            getWC(baseURL)
-        } else if command == "store" {
-            fmt.Println("Sending request to the server...")
-            pingServer(baseURL)
-        } else if command == "store ls" {
-            getFiles(baseURL) 
-        } else if strings.HasPrefix(command, "store freq-words") {
-            parts := strings.Fields(command)
-            limit := parts[3]
-            order := strings.Split(parts[4], "=")[1]
-            getFW(baseURL, limit, order)
-        } else if command == "exit" {
-            fmt.Println("Exiting program...")
-            break
-        } else {
-            fmt.Println("Unknown command:", command)
-        }
-    }
+    return opts, nil
 }
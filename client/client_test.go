@@ -1,13 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"file_storage_server/storeclient"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,10 +40,10 @@ func testGetWC(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	serverURL := mockServer.URL + "/wc"
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
 
-	result, err := getWC(serverURL)
-	if result != "All files contain 33 words" && err == nil {
+	code := c.run([]string{"wc"})
+	if code != exitOK || stdout.String() != "All files contain 33 words\n" {
 		t.Errorf("Incorrect output")
 	}
 }
@@ -44,10 +61,10 @@ func testPingServer(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	serverURL := mockServer.URL + "/ping"
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
 
-	result := pingServer(serverURL)
-	if result != "pong working!" {
+	code := c.run([]string{"ping"})
+	if code != exitOK || stdout.String() != "pong working!\n" {
 		t.Errorf("Incorrect output")
 	}
 }
@@ -60,14 +77,14 @@ func testGetFiles(t *testing.T) {
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "File ID: 12, Name: abc.txt\nFile ID: 13, Name: file1.txt\nFile ID: 14, Name: temp.txt")
+		fmt.Fprintln(w, `[{"id":12,"name":"abc.txt"},{"id":13,"name":"file1.txt"},{"id":14,"name":"temp.txt"}]`)
 	}))
 	defer mockServer.Close()
 
-	serverURL := mockServer.URL + "/list"
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
 
-	result := getFiles(serverURL)
-	if result != "File ID: 12, Name: abc.txt\nFile ID: 13, Name: file1.txt\nFile ID: 14, Name: temp.txt" {
+	code := c.run([]string{"ls"})
+	if code != exitOK || stdout.String() != "File ID: 12, Name: abc.txt\nFile ID: 13, Name: file1.txt\nFile ID: 14, Name: temp.txt\n" {
 		t.Errorf("Incorrect output")
 	}
 }
@@ -110,12 +127,13 @@ func TestDeleteFile(t *testing.T) {
 	}
 	defer os.Remove(testFileName) // Cleanup after test
 
-	// Call the deleteFile function
-	result, err := deleteFile(baseURL, testFileName)
+	// Run the rm command
+	c, stdout, stderr := newTestCLI(baseURL, "")
+	code := c.run([]string{"rm", testFileName})
 
 	// Check that no error occurred and the result is as expected
-	assert.NoError(t, err, "Expected no error when deleting file")
-	assert.Equal(t, "File successfully deleted!", result, "Expected file deletion success message")
+	assert.Equal(t, exitOK, code, "Expected no error when deleting file: %s", stderr)
+	assert.Equal(t, "File successfully deleted!\n", stdout.String(), "Expected file deletion success message")
 }
 
 func TestPostFile(t *testing.T) {
@@ -156,10 +174,11 @@ func TestPostFile(t *testing.T) {
 	}
 	defer os.Remove(testFileName) // Cleanup after test
 
-	result, err := postFile(mockServer.URL, []string{testFileName})
+	c, stdout, stderr := newTestCLI(mockServer.URL, "")
+	code := c.run([]string{"add", testFileName})
 
-	assert.NoError(t, err, "Expected no error when creating file")
-	assert.Equal(t, "Files created successfully!", result, "Expected file creation success message success message")
+	assert.Equal(t, exitOK, code, "Expected no error when creating file: %s", stderr)
+	assert.Equal(t, "Files created successfully!\n", stdout.String(), "Expected file creation success message success message")
 }
 
 func TestPutFile(t *testing.T) {
@@ -195,8 +214,691 @@ func TestPutFile(t *testing.T) {
 	defer os.Remove(testFileName)
 
 
-	result, err := putFile(mockServer.URL, testFileName)
+	c, stdout, stderr := newTestCLI(mockServer.URL, "")
+	code := c.run([]string{"update", testFileName})
 
-	assert.NoError(t, err, "Expected no error when updating file")
-	assert.Equal(t, "File updated successfully!\n", result, "Expected file deletion success message")
-}
\ No newline at end of file
+	assert.Equal(t, exitOK, code, "Expected no error when updating file: %s", stderr)
+	assert.Equal(t, "File updated successfully!\n", stdout.String(), "Expected file deletion success message")
+}
+
+func TestGrepFiles(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/grep" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("pattern") != "err.*" || query.Get("ignore_case") != "true" || query.Get("file") != "log.txt" {
+			http.Error(w, "Invalid query", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"file":"log.txt","line":2,"text":"ok"}`+"\n")
+		fmt.Fprint(w, `{"file":"log.txt","line":3,"text":"error found","match":true}`+"\n")
+	}))
+	defer mockServer.Close()
+
+	opts, err := parseGrepArgs(flag.NewFlagSet("grep", flag.ContinueOnError), []string{"-i", "-C", "2", "-A", "0", "err.*", "log.txt"})
+	assert.NoError(t, err)
+	assert.Equal(t, storeclient.GrepOptions{Pattern: "err.*", IgnoreCase: true, Before: 2, After: 0, Files: []string{"log.txt"}}, opts)
+
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+	code := c.run([]string{"grep", "-i", "err.*", "log.txt"})
+
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "log.txt-2-ok\nlog.txt:3:error found\n", stdout.String())
+}
+
+func TestGetStats(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/stats" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("file") != "a.txt" {
+			http.Error(w, "Invalid query", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"files":[{"name":"a.txt","lines":1,"words":2,"characters":12,"bytes":12,"unique_words":2}],"total":{"lines":1,"words":2,"characters":12,"bytes":12,"unique_words":2}}`)
+	}))
+	defer mockServer.Close()
+
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+	code := c.run([]string{"stats", "a.txt"})
+
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout.String(), "a.txt")
+	assert.Contains(t, stdout.String(), "total")
+
+	stdout.Reset()
+	code = c.run([]string{"stats", "-json", "a.txt"})
+
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, stdout.String(), `"unique_words": 2`)
+}
+
+func TestSplitRevision(t *testing.T) {
+	name, revision := splitRevision("notes.txt@3")
+	assert.Equal(t, "notes.txt", name)
+	assert.Equal(t, 3, revision)
+
+	name, revision = splitRevision("user@example.txt")
+	assert.Equal(t, "user@example.txt", name)
+	assert.Equal(t, 0, revision)
+
+	name, revision = splitRevision("notes.txt")
+	assert.Equal(t, "notes.txt", name)
+	assert.Equal(t, 0, revision)
+}
+
+func TestGetDiff(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/diff" || query.Get("a") != "a.txt" || query.Get("rev_a") != "1" || query.Get("b") != "a.txt" || query.Has("rev_b") {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "--- a.txt@1\n+++ a.txt\n@@ -1 +1 @@\n-old\n+new\n")
+	}))
+	defer mockServer.Close()
+
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+	code := c.run([]string{"diff", "a.txt@1", "a.txt"})
+
+	assert.Equal(t, exitOK, code)
+	diff := stdout.String()
+	assert.Equal(t, "--- a.txt@1\n+++ a.txt\n@@ -1 +1 @@\n-old\n+new\n", diff)
+
+	colored := colorizeDiff(diff, false)
+	assert.Contains(t, colored, colorRed+"-old"+colorReset)
+	assert.Contains(t, colored, colorGreen+"+new"+colorReset)
+	assert.Contains(t, colored, colorCyan+"@@ -1 +1 @@"+colorReset)
+}
+
+func TestColorizeWordDiff(t *testing.T) {
+	colored := colorizeDiff("the [-quick-]{+slow+} fox", true)
+
+	assert.Equal(t, "the "+colorRed+"[-quick-]"+colorReset+colorGreen+"{+slow+}"+colorReset+" fox", colored)
+}
+
+func TestPatchFile(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Method != http.MethodPatch || r.URL.Path != "/patch" || query.Get("name") != "notes.txt" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if query.Get("op") != "diff" || query.Get("base") != "abc" {
+			http.Error(w, "Base hash abc does not match", http.StatusConflict)
+			return
+		}
+		w.Header().Set("ETag", `"def"`)
+		fmt.Fprintln(w, "File patched successfully, new hash def")
+	}))
+	defer mockServer.Close()
+
+	testFileName := "testpatch.diff"
+	err := os.WriteFile(testFileName, []byte("@@ -1 +1 @@\n-a\n+b\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer os.Remove(testFileName)
+
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+	code := c.run([]string{"patch", "-base", "abc", "notes.txt", testFileName})
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "File patched successfully, new hash def\n", stdout.String())
+
+	c, _, stderr := newTestCLI(mockServer.URL, "")
+	code = c.run([]string{"patch", "notes.txt", testFileName})
+	assert.Equal(t, exitFailure, code)
+	assert.Contains(t, stderr.String(), "409")
+}
+
+func TestAppendFile(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPatch || r.URL.Query().Get("op") != "append" || string(body) != "more\n" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "File patched successfully, new hash def")
+	}))
+	defer mockServer.Close()
+
+	// Appended content is read from stdin with -
+	c, _, _ := newTestCLI(mockServer.URL, "more\n")
+	code := c.run([]string{"append", "notes.txt", "-"})
+
+	assert.Equal(t, exitOK, code)
+}
+
+func newTestCLI(baseURL string, stdin string) (*cli, *bytes.Buffer, *bytes.Buffer) {
+	var stdout, stderr bytes.Buffer
+	return &cli{
+		baseURL: baseURL,
+		stdin:   strings.NewReader(stdin),
+		stdout:  &stdout,
+		stderr:  &stderr,
+	}, &stdout, &stderr
+}
+
+func TestCLIUsageErrors(t *testing.T) {
+	c, _, stderr := newTestCLI("http://127.0.0.1:0", "")
+
+	assert.Equal(t, exitUsage, c.run(nil))
+	assert.Equal(t, exitUsage, c.run([]string{"frobnicate"}))
+	assert.Contains(t, stderr.String(), `unknown command "frobnicate"`)
+	assert.Equal(t, exitUsage, c.run([]string{"rm"}))
+	assert.Equal(t, exitUsage, c.run([]string{"ls", "-bogus"}))
+	assert.Equal(t, exitUsage, c.run([]string{"add", "-"}))
+}
+
+func TestCLIHelp(t *testing.T) {
+	c, stdout, _ := newTestCLI("http://127.0.0.1:0", "")
+
+	assert.Equal(t, exitOK, c.run([]string{"help"}))
+	assert.Contains(t, stdout.String(), "freq-words")
+
+	stdout.Reset()
+	assert.Equal(t, exitOK, c.run([]string{"help", "ls"}))
+	assert.Contains(t, stdout.String(), "usage: store ls [-json]")
+	assert.Contains(t, stdout.String(), "-json")
+
+	// Every command prints its usage, including the ones with subcommands
+	for _, cmd := range commands {
+		c, stdout, stderr := newTestCLI("http://127.0.0.1:0", "")
+		assert.Equal(t, exitOK, c.run([]string{"help", cmd.Name}), cmd.Name)
+		assert.Contains(t, stdout.String(), "usage: store "+cmd.Name, cmd.Name)
+		assert.Empty(t, stderr.String(), cmd.Name)
+	}
+
+	c, _, stderr := newTestCLI("http://127.0.0.1:0", "")
+	assert.Equal(t, exitOK, c.run([]string{"trash", "-h"}))
+	assert.Contains(t, stderr.String(), "usage: store trash ls")
+}
+
+func TestCLIListJSON(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/list" || r.URL.Query().Get("format") != "json" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `[{"id":12,"name":"abc.txt","hash_digest":"abc","bytes":3}]`)
+	}))
+	defer mockServer.Close()
+
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+
+	assert.Equal(t, exitOK, c.run([]string{"ls"}))
+	assert.Equal(t, "File ID: 12, Name: abc.txt\n", stdout.String())
+
+	stdout.Reset()
+	assert.Equal(t, exitOK, c.run([]string{"ls", "--json"}))
+	assert.Contains(t, stdout.String(), `"name": "abc.txt"`)
+}
+
+func TestCLIAddFromStdin(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("files")
+		if err != nil || r.Method != http.MethodPost || header.Filename != "notes.txt" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		content, _ := io.ReadAll(file)
+		if string(content) != "piped content" {
+			http.Error(w, "Invalid content", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Files uploaded successfully")
+	}))
+	defer mockServer.Close()
+
+	c, _, _ := newTestCLI(mockServer.URL, "piped content")
+
+	assert.Equal(t, exitOK, c.run([]string{"add", "-name", "notes.txt", "-"}))
+}
+
+func TestCLIFailureExitCode(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer mockServer.Close()
+
+	c, _, stderr := newTestCLI(mockServer.URL, "")
+
+	assert.Equal(t, exitFailure, c.run([]string{"stats"}))
+	assert.Contains(t, stderr.String(), "500")
+}
+
+func TestShell(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id":1,"name":"a.txt"}]`)
+	}))
+	defer mockServer.Close()
+
+	// The shell stops at end of input even without "exit"
+	c, stdout, _ := newTestCLI(mockServer.URL, "store ls\n\nls\n")
+
+	assert.NoError(t, c.shell())
+	assert.Equal(t, 2, strings.Count(stdout.String(), "File ID: 1, Name: a.txt"))
+}
+
+func TestShellQuoting(t *testing.T) {
+	var names []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, r.URL.Query().Get("name"))
+		fmt.Fprint(w, `[]`)
+	}))
+	defer mockServer.Close()
+
+	// Bad input is reported and the shell keeps reading
+	c, stdout, stderr := newTestCLI(mockServer.URL, "history 'my notes.txt'\nhistory \"unterminated\nfreq-words -n\nexit\nls\n")
+
+	assert.NoError(t, c.shell())
+	assert.Equal(t, []string{"my notes.txt"}, names)
+	assert.Contains(t, stderr.String(), "unterminated double quote")
+	assert.Contains(t, stderr.String(), "store freq-words: flag needs an argument")
+	assert.Contains(t, stdout.String(), "Exiting program...")
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"", nil},
+		{"  ls  -json ", []string{"ls", "-json"}},
+		{`add 'my file.txt'`, []string{"add", "my file.txt"}},
+		{`add "my \"quoted\" file.txt"`, []string{"add", `my "quoted" file.txt`}},
+		{`add my\ file.txt ''`, []string{"add", "my file.txt", ""}},
+		{`grep 'a b'"c d"e`, []string{"grep", "a bc de"}},
+	}
+	for _, test := range tests {
+		args, err := splitArgs(test.line)
+		assert.NoError(t, err, test.line)
+		assert.Equal(t, test.args, args, test.line)
+	}
+
+	for _, line := range []string{`add 'a`, `add "a`, `add a\`} {
+		_, err := splitArgs(line)
+		assert.Error(t, err, line)
+	}
+
+	for _, arg := range []string{"plain.txt", "my file.txt", "it's", `back\slash`, ""} {
+		args, err := splitArgs("rm " + quoteArg(arg))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"rm", arg}, args)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	cp := &completer{names: func() []string {
+		return []string{"notes.txt", "notes 2024.txt", "todo.txt"}
+	}}
+
+	complete := func(line string) string {
+		newLine, pos, ok := cp.complete(line, len(line))
+		if !ok {
+			return "<none>"
+		}
+		assert.Equal(t, len(newLine), pos)
+		return newLine
+	}
+
+	assert.Equal(t, "freq-words ", complete("fr"))
+	assert.Equal(t, "store history ", complete("store hi"))
+	assert.Equal(t, "<none>", complete("xyz"))
+	assert.Equal(t, "stats todo.txt ", complete("stats t"))
+	assert.Equal(t, "diff notes", complete("diff n"))
+	assert.Equal(t, "<none>", complete("diff notes"))
+	assert.Equal(t, "diff 'notes 2024.txt' ", complete("diff 'notes "))
+	assert.Equal(t, "diff 'notes 2024.txt' ", complete(`diff notes\ 2`))
+	assert.Equal(t, "<none>", complete("grep -"))
+
+	// The text after the cursor is kept
+	newLine, pos, ok := cp.complete("history to -json", len("history to"))
+	assert.True(t, ok)
+	assert.Equal(t, "history todo.txt  -json", newLine)
+	assert.Equal(t, len("history todo.txt "), pos)
+}
+
+func TestShellHistory(t *testing.T) {
+	dir := t.TempDir()
+	c, _, _ := newTestCLI("http://127.0.0.1:0", "")
+	c.configPath = filepath.Join(dir, "config.yaml")
+
+	history := c.loadHistory()
+	history.Add("ls")
+	history.Add("ls")
+	history.Add("  ")
+	history.Add("stats a.txt")
+
+	// A new session sees the commands of the previous one
+	history = c.loadHistory()
+	assert.Equal(t, 2, history.Len())
+	assert.Equal(t, "stats a.txt", history.At(0))
+	assert.Equal(t, "ls", history.At(1))
+
+	var lines []string
+	for i := 0; i < maxHistoryEntries+10; i++ {
+		lines = append(lines, fmt.Sprintf("history %d", i))
+	}
+	os.WriteFile(c.historyPath(), []byte(strings.Join(lines, "\n")+"\n"), 0600)
+
+	history = c.loadHistory()
+	assert.Equal(t, maxHistoryEntries, history.Len())
+	assert.Equal(t, "history 10", history.At(maxHistoryEntries-1))
+}
+
+func TestResolveProfilePrecedence(t *testing.T) {
+	t.Setenv("STORE_URL", "")
+	t.Setenv("STORE_TOKEN", "")
+	t.Setenv("STORE_PROFILE", "")
+
+	cfg := &Config{
+		CurrentProfile: "staging",
+		Profiles: map[string]*Profile{
+			"staging": {URL: "http://staging:2021", Token: "secret", Timeout: 5 * time.Second},
+		},
+	}
+
+	profile, err := cfg.resolveProfile(cfg.profileName(""), "")
+	assert.NoError(t, err)
+	assert.Equal(t, Profile{URL: "http://staging:2021", Token: "secret", Timeout: 5 * time.Second}, profile)
+
+	t.Setenv("STORE_URL", "http://env:2021")
+	profile, _ = cfg.resolveProfile("staging", "")
+	assert.Equal(t, "http://env:2021", profile.URL)
+
+	profile, _ = cfg.resolveProfile("staging", "http://flag:2021")
+	assert.Equal(t, "http://flag:2021", profile.URL)
+
+	profile, err = cfg.resolveProfile("default", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://env:2021", profile.URL)
+
+	_, err = cfg.resolveProfile("missing", "")
+	assert.Error(t, err)
+}
+
+func TestConfigSetGet(t *testing.T) {
+	t.Setenv("STORE_PROFILE", "")
+	configPath := filepath.Join(t.TempDir(), "store", "config.yaml")
+
+	c, stdout, _ := newTestCLI("", "")
+	assert.Equal(t, exitOK, c.main([]string{"-config", configPath, "-profile", "staging", "config", "set", "url", "http://staging:2021"}))
+	assert.Equal(t, exitOK, c.main([]string{"-config", configPath, "-profile", "staging", "config", "set", "timeout", "30s"}))
+	assert.Equal(t, exitUsage, c.main([]string{"-config", configPath, "config", "set", "colour", "blue"}))
+	// The server has no buckets, so there is no key to pick one
+	assert.Equal(t, exitUsage, c.main([]string{"-config", configPath, "config", "set", "bucket", "photos"}))
+	assert.Equal(t, exitOK, c.main([]string{"-config", configPath, "-profile", "staging", "config", "set", "retries", "0"}))
+	assert.Equal(t, exitUsage, c.main([]string{"-config", configPath, "config", "set", "retries", "many"}))
+	assert.Equal(t, exitOK, c.main([]string{"-config", configPath, "config", "use", "staging"}))
+
+	c, stdout, _ = newTestCLI("", "")
+	assert.Equal(t, exitOK, c.main([]string{"-config", configPath, "config", "get", "url"}))
+	assert.Equal(t, "http://staging:2021\n", stdout.String())
+
+	cfg, err := loadConfig(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "staging", cfg.CurrentProfile)
+	assert.Equal(t, 30*time.Second, cfg.Profiles["staging"].Timeout)
+	assert.Equal(t, 0, *cfg.Profiles["staging"].Retries)
+
+	info, err := os.Stat(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestStoreClientToken(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "pong working!")
+	}))
+	defer mockServer.Close()
+
+	client, err := newStoreClient(Profile{URL: mockServer.URL, Token: "secret"})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Ping(context.Background()))
+
+	client, err = newStoreClient(Profile{URL: mockServer.URL})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, client.Ping(context.Background()), storeclient.ErrUnauthorized)
+}
+
+func TestStoreClientRetries(t *testing.T) {
+	var attempts int
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "pong working!")
+	}))
+	defer mockServer.Close()
+
+	// Read requests are retried by default
+	client, err := newStoreClient(Profile{URL: mockServer.URL})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Ping(context.Background()))
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	noRetries := 0
+	client, _ = newStoreClient(Profile{URL: mockServer.URL, Retries: &noRetries})
+	assert.ErrorIs(t, client.Ping(context.Background()), storeclient.ErrServer)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestInterrupt(t *testing.T) {
+	received := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-r.Context().Done()
+	}))
+	defer mockServer.Close()
+
+	go func() {
+		<-received
+		process, _ := os.FindProcess(os.Getpid())
+		process.Signal(os.Interrupt)
+	}()
+
+	c, _, stderr := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitInterrupted, c.run([]string{"ls"}))
+	assert.Equal(t, "store ls: interrupted\n", stderr.String())
+}
+
+// writeClientCert writes a self-signed client certificate and its key to
+// dir and returns the certificate with the paths of the two files
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "alice"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, certFile, keyFile
+}
+
+func TestStoreClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "pong %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	mockServer.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	mockServer.TLS.ClientCAs.AddCert(clientCert)
+	mockServer.StartTLS()
+	defer mockServer.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mockServer.Certificate().Raw}), 0600)
+
+	client, err := newStoreClient(Profile{URL: mockServer.URL, CACert: caFile, ClientCert: certFile, ClientKey: keyFile})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Ping(context.Background()))
+
+	// The server's certificate is not trusted without the CA bundle
+	noRetries := 0
+	client, _ = newStoreClient(Profile{URL: mockServer.URL, ClientCert: certFile, ClientKey: keyFile, Retries: &noRetries})
+	assert.ErrorContains(t, client.Ping(context.Background()), "certificate")
+
+	_, err = newStoreClient(Profile{URL: mockServer.URL, ClientCert: certFile})
+	assert.ErrorContains(t, err, "client_cert and client_key must be set together")
+	_, err = newStoreClient(Profile{URL: mockServer.URL, CACert: keyFile})
+	assert.ErrorContains(t, err, "no certificates")
+
+	// Global flags override the profile
+	c, stdout, stderr := newTestCLI("", "")
+	code := c.main([]string{"-config", filepath.Join(dir, "config.yaml"), "-server", mockServer.URL,
+		"-cacert", caFile, "-cert", certFile, "-key", keyFile, "ping"})
+	assert.Equal(t, exitOK, code, stderr.String())
+	assert.Equal(t, "pong working!\n", stdout.String())
+}
+
+func TestStatus(t *testing.T) {
+	ready := true
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/readyz", r.URL.Path)
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		if ready {
+			fmt.Fprint(w, `{"status":"ok","checks":[{"name":"database","status":"ok","duration_seconds":0.0012}]}`)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"status":"unavailable","checks":[{"name":"database","status":"failed","error":"connection refused","duration_seconds":0.0003}]}`)
+	}))
+	defer mockServer.Close()
+
+	c, stdout, stderr := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"status"}), stderr.String())
+	assert.Contains(t, stdout.String(), "is ok\n")
+	assert.Regexp(t, `database\s+ok\s+1.2ms`, stdout.String())
+
+	// A server that is not ready is reported, and not retried
+	ready = false
+	requests = 0
+	c, stdout, stderr = newTestCLI(mockServer.URL, "")
+	c.client, _ = storeclient.New(mockServer.URL, storeclient.WithRetries(3, time.Millisecond))
+	assert.Equal(t, exitFailure, c.run([]string{"status", "-output", "csv"}))
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, "name,status,error,duration_seconds\ndatabase,failed,connection refused,0.0003\n", stdout.String())
+	assert.Contains(t, stderr.String(), "store status: server is not ready")
+
+	c, stdout, _ = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitFailure, c.run([]string{"status", "-q"}))
+	assert.Equal(t, "database\n", stdout.String())
+}
+
+func TestAudit(t *testing.T) {
+	var query url.Values
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/audit", r.URL.Path)
+		query = r.URL.Query()
+		fmt.Fprint(w, `[{"id":7,"time":"2024-05-02T10:00:00Z","actor":"ci","action":"delete","file_id":3,"name":"a.txt",`+
+			`"old_hash":"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08","new_hash":"","client_ip":"10.0.0.7","request_id":"abc"}]`)
+	}))
+	defer mockServer.Close()
+
+	c, stdout, stderr := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"audit", "-actor", "ci", "-action", "delete", "-since", "2024-05-01T00:00:00Z", "-n", "10"}), stderr.String())
+	assert.Equal(t, url.Values{"actor": {"ci"}, "action": {"delete"}, "since": {"2024-05-01T00:00:00Z"}, "limit": {"10"}}, query)
+	assert.Equal(t, "TIME                 ACTOR  ACTION  NAME   OLD HASH      NEW HASH  CLIENT    REQUEST\n"+
+		"2024-05-02 10:00:00  ci     delete  a.txt  9f86d081884c  -         10.0.0.7  abc\n", stdout.String())
+
+	c, stdout, _ = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"audit", "-q"}))
+	assert.Equal(t, "7\n", stdout.String())
+
+	c, _, stderr = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitUsage, c.run([]string{"audit", "-since", "last week"}))
+	assert.Contains(t, stderr.String(), `"last week" is not a time`)
+
+	now := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	since, err := parseTimeFlag("24h", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), since)
+}
+
+func TestTrash(t *testing.T) {
+	var requests []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/trash":
+			fmt.Fprint(w, `[{"id":3,"name":"a.txt","hash_digest":"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08","bytes":4,`+
+				`"created_at":"2024-05-01T10:00:00Z","deleted_at":"2024-05-02T10:00:00Z","purge_at":"2024-06-01T10:00:00Z"}]`)
+		case r.URL.Path == "/trash/restore" && r.URL.Query().Get("name") == "b.txt":
+			http.Error(w, "Can not restore b.txt", http.StatusConflict)
+		case r.URL.Path == "/trash/restore":
+			fmt.Fprintln(w, "File restored successfully")
+		case r.Method == http.MethodDelete && r.URL.Path == "/trash":
+			fmt.Fprint(w, `{"purged":5}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	c, stdout, stderr := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"trash", "ls"}), stderr.String())
+	assert.Equal(t, "NAME   DELETED              PURGE AT             BYTES  HASH\n"+
+		"a.txt  2024-05-02 10:00:00  2024-06-01 10:00:00  4      9f86d081884c\n", stdout.String())
+
+	c, stdout, _ = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"trash", "ls", "-q"}))
+	assert.Equal(t, "3\n", stdout.String())
+
+	requests = nil
+	c, _, stderr = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitFailure, c.run([]string{"trash", "restore", "a.txt", "b.txt"}))
+	assert.Equal(t, []string{"POST /trash/restore?name=a.txt", "POST /trash/restore?name=b.txt"}, requests)
+	assert.Contains(t, stderr.String(), "b.txt")
+	assert.NotContains(t, stderr.String(), "a.txt")
+
+	// Emptying the whole trash asks first
+	requests = nil
+	c, _, stderr = newTestCLI(mockServer.URL, "n\n")
+	assert.Equal(t, exitFailure, c.run([]string{"trash", "empty"}))
+	assert.Contains(t, stderr.String(), "aborted")
+	assert.Empty(t, requests)
+
+	c, stdout, stderr = newTestCLI(mockServer.URL, "y\n")
+	assert.Equal(t, exitOK, c.run([]string{"trash", "empty"}), stderr.String())
+	assert.Equal(t, []string{"DELETE /trash"}, requests)
+	assert.Contains(t, stdout.String(), "5 files deleted for good")
+
+	requests = nil
+	c, _, stderr = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"trash", "empty", "a.txt"}), stderr.String())
+	assert.Equal(t, []string{"DELETE /trash?name=a.txt"}, requests)
+
+	c, _, stderr = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitUsage, c.run([]string{"trash", "undelete"}))
+	assert.Contains(t, stderr.String(), `unknown subcommand "undelete"`)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"file_storage_server/storeclient"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultProfileName = "default"
+
+// Defaults of the profile settings that are not set
+const (
+	defaultTimeout   = 30 * time.Second
+	defaultRetries   = 3
+	defaultRetryWait = 200 * time.Millisecond
+)
+
+// Profile holds the settings used to talk to one server
+type Profile struct {
+	URL   string `yaml:"url,omitempty"`
+	Token string `yaml:"token,omitempty"`
+	// Timeout limits how long a request waits for the server to answer
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Retries is the number of times a failed read request is retried,
+	// nil for the default
+	Retries *int `yaml:"retries,omitempty"`
+	// CACert is a PEM bundle of the CAs trusted for https servers, on top
+	// of the system ones
+	CACert string `yaml:"ca_cert,omitempty"`
+	// ClientCert and ClientKey are a certificate and key for servers that
+	// authenticate clients with certificates
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+}
+
+// Config is the content of the client configuration file
+type Config struct {
+	CurrentProfile string              `yaml:"current_profile,omitempty"`
+	Profiles       map[string]*Profile `yaml:"profiles,omitempty"`
+}
+
+// defaultConfigPath returns $STORE_CONFIG or config.yaml in the user's
+// configuration directory, e.g. ~/.config/store/config.yaml
+func defaultConfigPath() (string, error) {
+	if path := os.Getenv("STORE_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "store", "config.yaml"), nil
+}
+
+// loadConfig reads the configuration file at path. A missing file is not an
+// error and results in an empty configuration.
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{Profiles: map[string]*Profile{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading config file: %v", err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+	if cfg.Profiles == nil {
+		cfg.Profiles = map[string]*Profile{}
+	}
+	return cfg, nil
+}
+
+// save writes the configuration to path. The file is only readable by the
+// user because profiles may contain tokens.
+func (cfg *Config) save(path string) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Error creating config directory: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("Error writing config file: %v", err)
+	}
+	return nil
+}
+
+// profileName picks the profile to use: the --profile flag, then
+// $STORE_PROFILE, then the current profile of the configuration file
+func (cfg *Config) profileName(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv("STORE_PROFILE"); env != "" {
+		return env
+	}
+	if cfg.CurrentProfile != "" {
+		return cfg.CurrentProfile
+	}
+	return defaultProfileName
+}
+
+// resolveProfile returns the settings of the named profile with
+// $STORE_URL, $STORE_TOKEN and the --server flag applied on top, in that
+// order of precedence
+func (cfg *Config) resolveProfile(name string, serverFlag string) (Profile, error) {
+	profile := Profile{URL: defaultServerURL}
+
+	if stored, ok := cfg.Profiles[name]; ok {
+		if stored.URL != "" {
+			profile.URL = stored.URL
+		}
+		profile.Token = stored.Token
+		profile.Timeout = stored.Timeout
+		profile.Retries = stored.Retries
+		profile.CACert = stored.CACert
+		profile.ClientCert = stored.ClientCert
+		profile.ClientKey = stored.ClientKey
+	} else if name != defaultProfileName {
+		return Profile{}, fmt.Errorf("profile %q does not exist", name)
+	}
+
+	if env := os.Getenv("STORE_URL"); env != "" {
+		profile.URL = env
+	}
+	if env := os.Getenv("STORE_TOKEN"); env != "" {
+		profile.Token = env
+	}
+	if serverFlag != "" {
+		profile.URL = serverFlag
+	}
+
+	return profile, nil
+}
+
+// newStoreClient returns a client for the profile's server, timeout,
+// retries and token
+func newStoreClient(profile Profile) (*storeclient.Client, error) {
+	timeout := profile.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	retries := defaultRetries
+	if profile.Retries != nil {
+		retries = *profile.Retries
+	}
+	opts := []storeclient.Option{
+		storeclient.WithTimeout(timeout),
+		storeclient.WithRetries(retries, defaultRetryWait),
+		storeclient.WithToken(profile.Token),
+	}
+	tlsConfig, err := profile.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, storeclient.WithTLSConfig(tlsConfig))
+	}
+	return storeclient.New(profile.URL, opts...)
+}
+
+// tlsConfig loads the CA bundle and client certificate of the profile, or
+// returns nil when it has none
+func (profile Profile) tlsConfig() (*tls.Config, error) {
+	if profile.CACert == "" && profile.ClientCert == "" && profile.ClientKey == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if profile.CACert != "" {
+		pem, err := os.ReadFile(profile.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Error reading CA bundle: no certificates in %s", profile.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if profile.ClientCert != "" || profile.ClientKey != "" {
+		if profile.ClientCert == "" || profile.ClientKey == "" {
+			return nil, errors.New("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(profile.ClientCert, profile.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// profileKeys lists the keys accepted by "store config set" and "get"
+var profileKeys = []string{"url", "token", "timeout", "retries", "ca_cert", "client_cert", "client_key"}
+
+func getProfileKey(profile *Profile, key string) (string, error) {
+	switch key {
+	case "url":
+		return profile.URL, nil
+	case "token":
+		return profile.Token, nil
+	case "timeout":
+		if profile.Timeout == 0 {
+			return "", nil
+		}
+		return profile.Timeout.String(), nil
+	case "retries":
+		if profile.Retries == nil {
+			return "", nil
+		}
+		return strconv.Itoa(*profile.Retries), nil
+	case "ca_cert":
+		return profile.CACert, nil
+	case "client_cert":
+		return profile.ClientCert, nil
+	case "client_key":
+		return profile.ClientKey, nil
+	}
+	return "", usageErrorf("unknown key %q, use one of %v", key, profileKeys)
+}
+
+func setProfileKey(profile *Profile, key string, value string) error {
+	switch key {
+	case "url":
+		profile.URL = value
+	case "token":
+		profile.Token = value
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return usageErrorf("invalid timeout %q", value)
+		}
+		profile.Timeout = timeout
+	case "retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return usageErrorf("invalid number of retries %q", value)
+		}
+		profile.Retries = &retries
+	case "ca_cert", "client_cert", "client_key":
+		// Paths are stored absolute so that the profile works from any
+		// directory
+		path, err := filepath.Abs(value)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "ca_cert":
+			profile.CACert = path
+		case "client_cert":
+			profile.ClientCert = path
+		default:
+			profile.ClientKey = path
+		}
+	default:
+		return usageErrorf("unknown key %q, use one of %v", key, profileKeys)
+	}
+	return nil
+}
+
+func runConfig(c *cli, flags *flag.FlagSet, args []string) error {
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usageErrorf("missing subcommand")
+	}
+
+	cfg, err := loadConfig(c.configPath)
+	if err != nil {
+		return err
+	}
+	name := cfg.profileName(c.profileName)
+
+	switch sub, rest := flags.Arg(0), flags.Args()[1:]; sub {
+	case "get":
+		if len(rest) > 1 {
+			return usageErrorf("expected at most one key")
+		}
+		profile, ok := cfg.Profiles[name]
+		if !ok {
+			profile = &Profile{}
+		}
+		if len(rest) == 1 {
+			value, err := getProfileKey(profile, rest[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(c.stdout, value)
+			return nil
+		}
+		fmt.Fprintf(c.stdout, "profile: %s\n", name)
+		for _, key := range profileKeys {
+			value, _ := getProfileKey(profile, key)
+			fmt.Fprintf(c.stdout, "%s: %s\n", key, value)
+		}
+		return nil
+
+	case "set":
+		if len(rest) != 2 {
+			return usageErrorf("expected a key and a value")
+		}
+		profile, ok := cfg.Profiles[name]
+		if !ok {
+			profile = &Profile{}
+			cfg.Profiles[name] = profile
+		}
+		if err := setProfileKey(profile, rest[0], rest[1]); err != nil {
+			return err
+		}
+		return cfg.save(c.configPath)
+
+	case "use":
+		if len(rest) != 1 {
+			return usageErrorf("expected a profile name")
+		}
+		if _, ok := cfg.Profiles[rest[0]]; !ok && rest[0] != defaultProfileName {
+			return fmt.Errorf("profile %q does not exist", rest[0])
+		}
+		cfg.CurrentProfile = rest[0]
+		return cfg.save(c.configPath)
+
+	case "profiles":
+		names := []string{}
+		for profileName := range cfg.Profiles {
+			names = append(names, profileName)
+		}
+		sort.Strings(names)
+		for _, profileName := range names {
+			marker := " "
+			if profileName == name {
+				marker = "*"
+			}
+			fmt.Fprintf(c.stdout, "%s %s\t%s\n", marker, profileName, cfg.Profiles[profileName].URL)
+		}
+		return nil
+	}
+
+	return usageErrorf("unknown subcommand %q", flags.Arg(0))
+}
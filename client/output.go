@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of the commands that print data
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputCSV   = "csv"
+)
+
+// outputOptions selects how a command prints its result. The defaults come
+// from the global -output and -q flags and can be changed per command.
+type outputOptions struct {
+	Format string
+	Quiet  bool
+}
+
+// result is the data printed by a command, in a form every output format
+// can use. Field names are the same in JSON, YAML and CSV.
+type result struct {
+	// Value is encoded as JSON or YAML
+	Value any
+	// Header and Rows are the CSV records
+	Header []string
+	Rows   [][]string
+	// IDs are printed one per line in quiet mode
+	IDs []string
+	// Table prints the result for people
+	Table func(w io.Writer)
+}
+
+func validOutputFormat(format string) bool {
+	switch format {
+	case outputTable, outputJSON, outputYAML, outputCSV:
+		return true
+	}
+	return false
+}
+
+// outputFlags registers -output, -q and the older -json flag
+func (c *cli) outputFlags(flags *flag.FlagSet) *outputOptions {
+	opts := &outputOptions{Format: c.output, Quiet: c.quiet}
+	if opts.Format == "" {
+		opts.Format = outputTable
+	}
+	flags.StringVar(&opts.Format, "output", opts.Format, "output format: table, json, yaml or csv")
+	flags.BoolVar(&opts.Quiet, "q", opts.Quiet, "print only the IDs, one per line")
+	flags.BoolFunc("json", "same as -output json", func(string) error {
+		opts.Format = outputJSON
+		return nil
+	})
+	return opts
+}
+
+func (o *outputOptions) check() error {
+	if !validOutputFormat(o.Format) {
+		return usageErrorf("invalid output format %q, use table, json, yaml or csv", o.Format)
+	}
+	return nil
+}
+
+// print writes r to stdout in the selected format
+func (c *cli) print(opts *outputOptions, r result) error {
+	if opts.Quiet {
+		for _, id := range r.IDs {
+			fmt.Fprintln(c.stdout, id)
+		}
+		return nil
+	}
+
+	switch opts.Format {
+	case outputJSON:
+		return c.writeJSON(r.Value)
+	case outputYAML:
+		return writeYAML(c.stdout, r.Value)
+	case outputCSV:
+		w := csv.NewWriter(c.stdout)
+		w.Write(r.Header)
+		w.WriteAll(r.Rows)
+		return w.Error()
+	default:
+		r.Table(c.stdout)
+		return nil
+	}
+}
+
+// writeYAML encodes v as YAML with the field names and order of its JSON
+// encoding. The JSON is decoded as a YAML node tree, JSON being a subset of
+// YAML, and printed in block style.
+func writeYAML(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	resetStyle(&node)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func resetStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		resetStyle(child)
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.Format(time.RFC3339)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// success prints the message of a command that succeeded, unless quiet
+func (c *cli) success(format string, args ...any) {
+	if !c.quiet {
+		fmt.Fprintf(c.stdout, format+"\n", args...)
+	}
+}
+
+// printHash prints the new hash of a patched file, alone when quiet
+func (c *cli) printHash(hash string) {
+	if c.quiet {
+		fmt.Fprintln(c.stdout, hash)
+		return
+	}
+	fmt.Fprintf(c.stdout, "File patched successfully, new hash %s\n", hash)
+}
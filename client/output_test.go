@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputFormats(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			fmt.Fprint(w, `[{"id":12,"name":"a,b.txt","hash_digest":"abc","bytes":3,"created_at":"2024-05-01T10:00:00Z","updated_at":"2024-05-01T10:00:00Z"}]`)
+		case "/history":
+			fmt.Fprint(w, `[{"revision":2,"hash_digest":"def","bytes":5,"created_at":"2024-05-02T10:00:00Z"},{"revision":1,"hash_digest":"abc","bytes":3,"created_at":"2024-05-01T10:00:00Z"}]`)
+		case "/fw":
+			fmt.Fprint(w, `[{"word":"the","count":4}]`)
+		case "/wc":
+			fmt.Fprint(w, "All files contain 33 words")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ls", "-output", "csv"}, "id,name,hash_digest,bytes,created_at,updated_at\n" +
+			"12,\"a,b.txt\",abc,3,2024-05-01T10:00:00Z,2024-05-01T10:00:00Z\n"},
+		{[]string{"ls", "-q"}, "12\n"},
+		{[]string{"history", "-output", "yaml", "a,b.txt"}, "- revision: 2\n  hash_digest: def\n  bytes: 5\n  created_at: \"2024-05-02T10:00:00Z\"\n" +
+			"- revision: 1\n  hash_digest: abc\n  bytes: 3\n  created_at: \"2024-05-01T10:00:00Z\"\n"},
+		{[]string{"history", "-q", "a,b.txt"}, "2\n1\n"},
+		{[]string{"freq-words", "-output", "json"}, "[\n  {\n    \"word\": \"the\",\n    \"count\": 4\n  }\n]\n"},
+		{[]string{"freq-words", "-output", "csv"}, "word,count\nthe,4\n"},
+		{[]string{"wc", "-output", "yaml"}, "words: 33\n"},
+		{[]string{"wc", "-q"}, "33\n"},
+	}
+
+	for _, test := range tests {
+		c, stdout, stderr := newTestCLI(mockServer.URL, "")
+		assert.Equal(t, exitOK, c.run(test.args), "%v: %s", test.args, stderr)
+		assert.Equal(t, test.want, stdout.String(), "%v", test.args)
+	}
+
+	c, _, stderr := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitUsage, c.run([]string{"ls", "-output", "xml"}))
+	assert.Contains(t, stderr.String(), `invalid output format "xml"`)
+}
+
+func TestGlobalOutputFlags(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			fmt.Fprint(w, `[{"id":12,"name":"a.txt"}]`)
+		case "/ping":
+			fmt.Fprint(w, "pong working!")
+		}
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("STORE_URL", "")
+	config := t.TempDir() + "/config.yaml"
+
+	c, stdout, _ := newTestCLI("", "")
+	assert.Equal(t, exitOK, c.main([]string{"-config", config, "-server", mockServer.URL, "-output", "csv", "ls"}))
+	assert.Equal(t, "id,name,hash_digest,bytes,created_at,updated_at\n12,a.txt,,0,0001-01-01T00:00:00Z,0001-01-01T00:00:00Z\n", stdout.String())
+
+	// Quiet mode prints nothing for commands without data
+	c, stdout, _ = newTestCLI("", "")
+	assert.Equal(t, exitOK, c.main([]string{"-config", config, "-server", mockServer.URL, "-q", "ping"}))
+	assert.Empty(t, stdout.String())
+
+	c, _, stderr := newTestCLI("", "")
+	assert.Equal(t, exitUsage, c.main([]string{"-config", config, "-output", "xml", "ls"}))
+	assert.Contains(t, stderr.String(), `invalid output format "xml"`)
+}
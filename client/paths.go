@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// hasGlobMeta reports whether arg is a glob pattern rather than a name
+func hasGlobMeta(arg string) bool {
+	return strings.ContainsAny(arg, "*?[")
+}
+
+// expandPaths turns command line arguments into a list of local files.
+// Globs are expanded, with ** matching any number of directories, and
+// directories are walked when recursive is set. "-" is kept as is for
+// stdin. Every argument must match at least one file.
+func expandPaths(args []string, recursive bool) ([]string, error) {
+	var paths []string
+	seen := map[string]bool{}
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+
+	for _, arg := range args {
+		if arg == "-" {
+			add(arg)
+			continue
+		}
+
+		matches := []string{arg}
+		if hasGlobMeta(arg) {
+			var err error
+			matches, err = expandGlob(arg)
+			if err != nil {
+				return nil, usageErrorf("invalid pattern %q: %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("Error opening file '%s': %v", match, err)
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+			if !recursive {
+				// Globs such as * also match directories, which are skipped
+				if hasGlobMeta(arg) {
+					continue
+				}
+				return nil, usageErrorf("%s is a directory, use -r to include the files in it", match)
+			}
+			files, err := walkFiles(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				add(file)
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// walkFiles returns the regular files under dir
+func walkFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// expandGlob returns the files matching pattern. Unlike filepath.Glob, a
+// ** path element matches any number of directories.
+func expandGlob(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	for _, segment := range segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// Walk from the longest leading part without wildcards
+	static := 0
+	for static < len(segments)-1 && !hasGlobMeta(segments[static]) {
+		static++
+	}
+	root := filepath.FromSlash(strings.Join(segments[:static], "/"))
+	if root == "" {
+		root = "."
+		if strings.HasPrefix(pattern, "/") {
+			root = "/"
+		}
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root || entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if matchSegments(segments[static:], strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return matches, err
+}
+
+// matchSegments matches a path split into elements against a pattern split
+// the same way, where a ** element matches zero or more path elements
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchSegments(pattern[1:], name[1:])
+}
+
+// checkStoredNames returns an error when two files would be stored under
+// the same name, since the server keeps only the base name of a file
+func checkStoredNames(paths []string) error {
+	stored := map[string]string{}
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if other, ok := stored[name]; ok {
+			return fmt.Errorf("%s and %s would both be stored as %s", other, p, name)
+		}
+		stored[name] = p
+	}
+	return nil
+}
+
+// matchRemote returns the stored names matching a name or glob pattern.
+// Stored names never have directories, so patterns with a / are refused
+// rather than matching nothing.
+func matchRemote(names []string, pattern string) ([]string, error) {
+	if strings.Contains(pattern, "/") {
+		return nil, usageErrorf("%q has a directory, but files are stored under their base name only, e.g. %q",
+			pattern, path.Base(pattern))
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, usageErrorf("invalid pattern %q: %v", pattern, err)
+	}
+	var matches []string
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	return matches, nil
+}
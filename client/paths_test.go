@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTree creates files with their path as content under a new directory
+// and changes into it for the duration of the test
+func makeTree(t *testing.T, files ...string) {
+	dir := t.TempDir()
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(file), 0644)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestExpandPaths(t *testing.T) {
+	makeTree(t, "a.txt", "b.md", "docs/c.md", "docs/deep/d.md", "docs/deep/e.txt")
+
+	paths, err := expandPaths([]string{"*.txt", "a.txt", "b.md"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.md"}, paths)
+
+	paths, err = expandPaths([]string{"**/*.md"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.md", filepath.Join("docs", "c.md"), filepath.Join("docs", "deep", "d.md")}, paths)
+
+	paths, err = expandPaths([]string{"docs/**/*.txt"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("docs", "deep", "e.txt")}, paths)
+
+	// Directories are only walked with -r, and skipped when matched by a glob
+	_, err = expandPaths([]string{"docs"}, false)
+	assert.ErrorContains(t, err, "docs is a directory, use -r")
+	paths, err = expandPaths([]string{"*"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.md"}, paths)
+	paths, err = expandPaths([]string{"docs"}, true)
+	assert.NoError(t, err)
+	assert.Len(t, paths, 3)
+
+	_, err = expandPaths([]string{"*.go"}, false)
+	assert.EqualError(t, err, `no files match "*.go"`)
+	_, err = expandPaths([]string{"missing.txt"}, false)
+	assert.Error(t, err)
+
+	assert.EqualError(t, checkStoredNames([]string{"a/x.txt", "b/x.txt"}), "a/x.txt and b/x.txt would both be stored as x.txt")
+}
+
+func TestMatchRemote(t *testing.T) {
+	names := []string{"logs-2024-01.txt", "logs-2024-02.txt", "notes.md"}
+
+	matches, err := matchRemote(names, "logs-2024-*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"logs-2024-01.txt", "logs-2024-02.txt"}, matches)
+
+	_, err = matchRemote(names, "logs/2024-*")
+	var usage usageError
+	assert.ErrorAs(t, err, &usage)
+	assert.ErrorContains(t, err, `stored under their base name only, e.g. "2024-*"`)
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"**/*.md", "a.md", true},
+		{"**/*.md", "x/y/a.md", true},
+		{"x/**/a.md", "x/a.md", true},
+		{"x/**/a.md", "y/a.md", false},
+		{"**", "x/y", true},
+		{"*.md", "x/a.md", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.match, matchSegments(splitSlash(test.pattern), splitSlash(test.name)), "%s %s", test.pattern, test.name)
+	}
+}
+
+func splitSlash(s string) []string {
+	return strings.Split(s, "/")
+}
+
+func TestRmRemoteGlob(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			fmt.Fprint(w, `[{"name":"logs-2024-01.txt"},{"name":"logs-2024-02.txt"},{"name":"logs-2025-01.txt"},{"name":"notes.txt"}]`)
+		case "/delete":
+			mu.Lock()
+			deleted = append(deleted, r.URL.Query().Get("name"))
+			mu.Unlock()
+		}
+	}))
+	defer mockServer.Close()
+	makeTree(t)
+
+	// Declining the confirmation deletes nothing
+	c, stdout, _ := newTestCLI(mockServer.URL, "n\n")
+	assert.Equal(t, exitFailure, c.run([]string{"rm", "logs-2024-*"}))
+	assert.Equal(t, "The following 2 stored files will be deleted:\n  logs-2024-01.txt\n  logs-2024-02.txt\n", stdout.String())
+	assert.Empty(t, deleted)
+
+	c, stdout, stderr := newTestCLI(mockServer.URL, "y\n")
+	assert.Equal(t, exitOK, c.run([]string{"rm", "logs-2024-*", "notes.txt"}))
+	assert.Contains(t, stderr.String(), "Delete 3 files? [y/N]")
+	assert.Contains(t, stdout.String(), "3 files successfully deleted!")
+	sort.Strings(deleted)
+	assert.Equal(t, []string{"logs-2024-01.txt", "logs-2024-02.txt", "notes.txt"}, deleted)
+
+	// Plain names and -y do not ask
+	deleted = nil
+	c, _, stderr = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"rm", "-y", "logs-2025-*"}))
+	assert.Equal(t, exitOK, c.run([]string{"rm", "notes.txt"}))
+	assert.Empty(t, stderr.String())
+	assert.Equal(t, []string{"logs-2025-01.txt", "notes.txt"}, deleted)
+
+	c, _, stderr = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitFailure, c.run([]string{"rm", "missing-*"}))
+	assert.Contains(t, stderr.String(), `no stored file matches "missing-*"`)
+}
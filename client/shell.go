@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	maxHistoryEntries = 1000
+	// remoteNamesTTL is how long the file names used for completion are
+	// cached before they are listed again
+	remoteNamesTTL = 10 * time.Second
+)
+
+// shell reads commands from stdin until "exit" or end of input. Commands
+// may be typed with or without the leading "store" and are split into
+// arguments the way a POSIX shell does, so names containing spaces can be
+// quoted. On a terminal, lines can be edited, earlier commands are recalled
+// with the arrow keys and tab completes commands and file names.
+func (c *cli) shell() error {
+	fmt.Fprintln(c.stdout, "CLI Program started. Type 'store' to send a request to the server.")
+
+	lines := c.newLineReader()
+
+	for {
+		line, err := lines.readLine("> ")
+		if errors.Is(err, io.EOF) {
+			// Ctrl-D, Ctrl-C or end of piped input
+			fmt.Fprintln(c.stdout)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(c.stderr, "store: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if args[0] == "exit" || args[0] == "quit" {
+			fmt.Fprintln(c.stdout, "Exiting program...")
+			return nil
+		}
+		if args[0] == "store" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			fmt.Fprintln(c.stdout, "Sending request to the server...")
+			args = []string{"ping"}
+		}
+		if args[0] == "shell" {
+			fmt.Fprintln(c.stdout, "Already in the shell")
+			continue
+		}
+
+		c.run(args)
+	}
+}
+
+// lineReader reads the lines typed into the shell
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// scannerLineReader reads lines from input that is not a terminal, such as
+// a pipe
+type scannerLineReader struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+func (s scannerLineReader) readLine(prompt string) (string, error) {
+	fmt.Fprint(s.out, prompt)
+	if !s.scanner.Scan() {
+		if err := s.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return s.scanner.Text(), nil
+}
+
+// terminalLineReader edits lines on a terminal. The terminal is only in raw
+// mode while a line is read, so commands print their output normally.
+type terminalLineReader struct {
+	fd       int
+	terminal *term.Terminal
+}
+
+func (t terminalLineReader) readLine(prompt string) (string, error) {
+	state, err := term.MakeRaw(t.fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(t.fd, state)
+
+	if width, height, err := term.GetSize(t.fd); err == nil && width > 0 {
+		t.terminal.SetSize(width, height)
+	}
+	t.terminal.SetPrompt(prompt)
+	return t.terminal.ReadLine()
+}
+
+// newLineReader returns a terminal line editor when the shell runs on a
+// terminal and a plain line scanner otherwise. Only commands typed on a
+// terminal are recorded in the history.
+func (c *cli) newLineReader() lineReader {
+	in, inOK := c.stdin.(*os.File)
+	out, outOK := c.stdout.(*os.File)
+	if !inOK || !outOK || !term.IsTerminal(int(in.Fd())) || !term.IsTerminal(int(out.Fd())) {
+		return scannerLineReader{scanner: bufio.NewScanner(c.stdin), out: c.stdout}
+	}
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{in, out}, "> ")
+	terminal.History = c.loadHistory()
+
+	completer := &completer{names: c.remoteNames}
+	terminal.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return completer.complete(line, pos)
+	}
+
+	return terminalLineReader{fd: int(in.Fd()), terminal: terminal}
+}
+
+// remoteNames returns the names of the stored files, cached for a few
+// seconds so that completion does not list the files on every key press
+func (c *cli) remoteNames() []string {
+	if c.names != nil && time.Since(c.namesListedAt) < remoteNamesTTL {
+		return c.names
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return nil
+	}
+	files, err := client.List(c.context())
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	c.names, c.namesListedAt = names, time.Now()
+	return names
+}
+
+// splitArgs splits a command line into arguments. Single quotes keep
+// everything up to the closing quote, double quotes keep everything but
+// allow \" and \\ escapes, and a backslash outside of quotes escapes the
+// next character.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inWord := false
+
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+
+		case ch == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			current.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case ch == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+					i++
+				}
+				current.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+
+		case ch == '\\':
+			if i+1 == len(line) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			current.WriteByte(line[i])
+			inWord = true
+
+		default:
+			current.WriteByte(ch)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// quoteArg quotes an argument so that splitArgs returns it unchanged
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t'\"\\") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// localFileCommands take local files as arguments, every other command
+// takes the names of stored files
+var localFileCommands = map[string]bool{"add": true, "update": true, "rm": true}
+
+// completer completes the word before the cursor with a command name, a
+// local file or a stored file name
+type completer struct {
+	names func() []string
+}
+
+func (cp *completer) complete(line string, pos int) (string, int, bool) {
+	before, after := line[:pos], line[pos:]
+
+	start := wordStart(before)
+	prefix, ok := unquotePartial(before[start:])
+	if !ok {
+		return "", 0, false
+	}
+	words, err := splitArgs(before[:start])
+	if err != nil {
+		return "", 0, false
+	}
+	if len(words) > 0 && words[0] == "store" {
+		words = words[1:]
+	}
+
+	var candidates []string
+	switch {
+	case len(words) == 0:
+		candidates = append(candidates, "exit", "quit")
+		for _, cmd := range commands {
+			candidates = append(candidates, cmd.Name)
+		}
+	case strings.HasPrefix(prefix, "-"):
+		return "", 0, false
+	case localFileCommands[words[0]]:
+		candidates = localFiles(prefix)
+	default:
+		candidates = cp.names()
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(matches)
+
+	var completion string
+	if len(matches) == 1 {
+		completion = quoteArg(matches[0])
+		if !strings.HasSuffix(matches[0], string(filepath.Separator)) {
+			completion += " "
+		} else if strings.HasSuffix(completion, "'") {
+			// Leave the quote open so the path can be completed further
+			completion = strings.TrimSuffix(completion, "'")
+		}
+	} else {
+		common := longestCommonPrefix(matches)
+		if common == prefix {
+			return "", 0, false
+		}
+		// Leave the quote open so the name can be typed further
+		completion = strings.TrimSuffix(quoteArg(common), "'")
+	}
+
+	newLine := before[:start] + completion + after
+	return newLine, start + len(completion), true
+}
+
+// wordStart returns the index where the last word of line starts, ignoring
+// spaces inside quotes
+func wordStart(line string) int {
+	start := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch ch := line[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else if ch == '\\' && quote == '"' {
+				i++
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '\\':
+			i++
+		case ch == ' ' || ch == '\t':
+			start = i + 1
+		}
+	}
+	return start
+}
+
+// unquotePartial returns the value of a word that is still being typed and
+// may have an unterminated quote
+func unquotePartial(word string) (string, bool) {
+	for _, closing := range []string{"", "'", `"`} {
+		if args, err := splitArgs(word + closing); err == nil && len(args) <= 1 {
+			if len(args) == 0 {
+				return "", true
+			}
+			return args[0], true
+		}
+	}
+	return "", false
+}
+
+// localFiles returns the local paths starting with prefix. Directories end
+// with a slash so completion can continue inside them.
+func localFiles(prefix string) []string {
+	matches, _ := filepath.Glob(escapeGlob(prefix) + "*")
+	for i, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			matches[i] = match + string(filepath.Separator)
+		}
+	}
+	return matches
+}
+
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func longestCommonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// shellHistory holds the commands typed into the shell, most recent last.
+// New commands are appended to a file so they are kept across sessions.
+type shellHistory struct {
+	entries []string
+	path    string
+}
+
+// historyPath returns the history file next to the configuration file, or
+// an empty path when there is no configuration file
+func (c *cli) historyPath() string {
+	if c.configPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(c.configPath), "history")
+}
+
+// loadHistory reads the history file. Errors are ignored since the shell
+// works without history.
+func (c *cli) loadHistory() *shellHistory {
+	h := &shellHistory{path: c.historyPath()}
+	if h.path == "" {
+		return h
+	}
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return h
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+
+	// Rewrite the file when it has grown past the limit
+	if len(h.entries) > maxHistoryEntries {
+		h.entries = h.entries[len(h.entries)-maxHistoryEntries:]
+		os.WriteFile(h.path, []byte(strings.Join(h.entries, "\n")+"\n"), 0600)
+	}
+	return h
+}
+
+// Add records a command unless it repeats the previous one
+func (h *shellHistory) Add(entry string) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" || strings.ContainsAny(entry, "\r\n") {
+		return
+	}
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry {
+		return
+	}
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > maxHistoryEntries {
+		h.entries = h.entries[1:]
+	}
+
+	if h.path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return
+	}
+	file, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, entry)
+}
+
+// Len and At let the terminal recall earlier commands with the arrow keys.
+// Index 0 is the most recent command.
+func (h *shellHistory) Len() int {
+	return len(h.entries)
+}
+
+func (h *shellHistory) At(idx int) string {
+	return h.entries[len(h.entries)-1-idx]
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"file_storage_server/storeclient"
+)
+
+const (
+	// syncStateFile records the hashes of the files after the last sync,
+	// which two-way sync needs to tell which side changed a file
+	syncStateFile = ".store-sync.json"
+	// syncIgnoreFile lists glob patterns of files that are not synced, one
+	// per line
+	syncIgnoreFile = ".storeignore"
+)
+
+type syncOptions struct {
+	// Delete removes files that were deleted on the other side
+	Delete bool
+	// TwoWay also downloads files that are new or changed on the server
+	TwoWay bool
+}
+
+type syncActionKind int
+
+const (
+	syncUpload syncActionKind = iota
+	syncDownload
+	syncDeleteRemote
+	syncDeleteLocal
+	syncConflict
+)
+
+func (k syncActionKind) String() string {
+	switch k {
+	case syncUpload:
+		return "upload"
+	case syncDownload:
+		return "download"
+	case syncDeleteRemote:
+		return "delete remote"
+	case syncDeleteLocal:
+		return "delete local"
+	}
+	return "conflict"
+}
+
+type syncAction struct {
+	Kind   syncActionKind
+	Name   string
+	Reason string
+}
+
+// syncState is the content of the state file
+type syncState struct {
+	Server string            `json:"server"`
+	Files  map[string]string `json:"files"`
+}
+
+// planSync compares the hashes of the local and remote files, by name, and
+// returns what has to be done to bring both sides in sync. base holds the
+// hashes after the last sync.
+//
+// By default the directory is mirrored to the server: new and changed local
+// files are uploaded, and with Delete remote files missing locally are
+// deleted. In two-way mode changes on either side are copied to the other
+// side, and a file changed on both sides since the last sync is a conflict.
+func planSync(local, remote, base map[string]string, opts syncOptions) []syncAction {
+	names := map[string]bool{}
+	for name := range local {
+		names[name] = true
+	}
+	for name := range remote {
+		names[name] = true
+	}
+
+	var actions []syncAction
+	add := func(kind syncActionKind, name string, reason string) {
+		actions = append(actions, syncAction{Kind: kind, Name: name, Reason: reason})
+	}
+
+	for name := range names {
+		l, hasLocal := local[name]
+		r, hasRemote := remote[name]
+		b, hasBase := base[name]
+
+		if hasLocal && hasRemote && l == r {
+			continue
+		}
+
+		if !opts.TwoWay {
+			switch {
+			case !hasRemote:
+				add(syncUpload, name, "new")
+			case hasLocal:
+				add(syncUpload, name, "changed")
+			case opts.Delete:
+				add(syncDeleteRemote, name, "missing locally")
+			}
+			continue
+		}
+
+		switch {
+		case !hasLocal:
+			switch {
+			case !hasBase:
+				add(syncDownload, name, "new")
+			case !opts.Delete:
+				add(syncDownload, name, "missing locally")
+			case b == r:
+				add(syncDeleteRemote, name, "deleted locally")
+			default:
+				add(syncConflict, name, "deleted locally and changed on the server")
+			}
+		case !hasRemote:
+			switch {
+			case !hasBase:
+				add(syncUpload, name, "new")
+			case !opts.Delete:
+				add(syncUpload, name, "missing on the server")
+			case b == l:
+				add(syncDeleteLocal, name, "deleted on the server")
+			default:
+				add(syncConflict, name, "changed locally and deleted on the server")
+			}
+		case hasBase && b == l:
+			add(syncDownload, name, "changed on the server")
+		case hasBase && b == r:
+			add(syncUpload, name, "changed")
+		default:
+			add(syncConflict, name, "changed locally and on the server")
+		}
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Name < actions[j].Name
+	})
+	return actions
+}
+
+// isIgnored reports whether name matches one of the glob patterns. The
+// files used by sync itself are always ignored.
+func isIgnored(name string, patterns []string) bool {
+	if name == syncStateFile || name == syncIgnoreFile {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readIgnoreFile returns the patterns in the ignore file of dir. Empty lines
+// and lines starting with # are skipped.
+func readIgnoreFile(dir string) ([]string, error) {
+	file, err := os.Open(filepath.Join(dir, syncIgnoreFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s", line, syncIgnoreFile)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// localHashes returns the SHA-256 hashes of the regular files in dir.
+// Subdirectories are skipped because stored files have flat names.
+func localHashes(dir string, ignore []string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isIgnored(entry.Name(), ignore) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(content)
+		hashes[entry.Name()] = hex.EncodeToString(hash[:])
+	}
+	return hashes, nil
+}
+
+// loadSyncState reads the state file of dir. The state is discarded when it
+// was recorded for another server.
+func loadSyncState(dir string, server string) (*syncState, error) {
+	state := &syncState{Server: server, Files: map[string]string{}}
+
+	data, err := os.ReadFile(filepath.Join(dir, syncStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var stored syncState
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", syncStateFile, err)
+	}
+	if stored.Server == server && stored.Files != nil {
+		state.Files = stored.Files
+	}
+	return state, nil
+}
+
+func (s *syncState) save(dir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, syncStateFile), append(data, '\n'), 0644)
+}
+
+// writeFileAtomic replaces path with what write writes, so that an
+// interrupted download never leaves a partial file behind
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func runSync(c *cli, flags *flag.FlagSet, args []string) error {
+	var opts syncOptions
+	flags.BoolVar(&opts.Delete, "delete", false, "delete files that were deleted on the other side")
+	flags.BoolVar(&opts.TwoWay, "two-way", false, "also download files that are new or changed on the server")
+	dryRun := flags.Bool("dry-run", false, "only print what would be done")
+	parallel := flags.Int("parallel", defaultParallel, "number of files to transfer at the same time")
+	var ignore []string
+	flags.Func("ignore", "glob pattern of files to skip, may be repeated", func(pattern string) error {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+		ignore = append(ignore, pattern)
+		return nil
+	})
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageErrorf("expected exactly one directory")
+	}
+	dir := flags.Arg(0)
+
+	filePatterns, err := readIgnoreFile(dir)
+	if err != nil {
+		return err
+	}
+	ignore = append(ignore, filePatterns...)
+
+	local, err := localHashes(dir, ignore)
+	if err != nil {
+		return err
+	}
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+	files, err := client.List(c.context())
+	if err != nil {
+		return err
+	}
+	remote := map[string]string{}
+	remoteSizes := map[string]int64{}
+	for _, file := range files {
+		if !isIgnored(file.Name, ignore) {
+			remote[file.Name] = file.HashDigest
+			remoteSizes[file.Name] = int64(file.Bytes)
+		}
+	}
+
+	state, err := loadSyncState(dir, client.BaseURL())
+	if err != nil {
+		return err
+	}
+
+	actions := planSync(local, remote, state.Files, opts)
+	if *dryRun {
+		for _, action := range actions {
+			fmt.Fprintf(c.stdout, "would %s %s (%s)\n", action.Kind, action.Name, action.Reason)
+		}
+		if len(actions) == 0 {
+			fmt.Fprintln(c.stdout, "Already in sync")
+		}
+		return nil
+	}
+
+	// Files that are equal on both sides are in sync already
+	for name, hash := range local {
+		if remote[name] == hash {
+			state.Files[name] = hash
+		}
+	}
+
+	err = c.applySync(client, dir, actions, local, remoteSizes, state, *parallel)
+	if saveErr := state.save(dir); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return err
+	}
+	if len(actions) == 0 {
+		fmt.Fprintln(c.stdout, "Already in sync")
+	}
+	return nil
+}
+
+// applySync carries out the actions and records the new hash of every
+// synced file in state. Uploads and downloads run in parallel.
+func (c *cli) applySync(client *storeclient.Client, dir string, actions []syncAction, local map[string]string, remoteSizes map[string]int64, state *syncState, parallel int) error {
+	var mu sync.Mutex
+	pb := &progressBars{out: c.progressOutput(), start: time.Now()}
+	done := func(action syncAction, update func()) {
+		mu.Lock()
+		update()
+		mu.Unlock()
+		pb.println(c.stdout, fmt.Sprintf("%s %s (%s)", action.Kind, action.Name, action.Reason))
+	}
+
+	var transfers []transfer
+	var others []syncAction
+	for _, action := range actions {
+		action := action
+		path := filepath.Join(dir, action.Name)
+
+		switch action.Kind {
+		case syncUpload:
+			var size int64
+			if info, err := os.Stat(path); err == nil {
+				size = info.Size()
+			}
+			transfers = append(transfers, transfer{
+				Name: action.Name,
+				Size: size,
+				Run: func(ctx context.Context, p *transferProgress) error {
+					file, err := os.Open(path)
+					if err != nil {
+						return err
+					}
+					defer file.Close()
+					upload := storeclient.Upload{Name: action.Name, Content: p.Reader(file)}
+					if err := client.Update(ctx, upload); err != nil {
+						return fmt.Errorf("uploading: %w", err)
+					}
+					done(action, func() { state.Files[action.Name] = local[action.Name] })
+					return nil
+				},
+			})
+
+		case syncDownload:
+			transfers = append(transfers, transfer{
+				Name: action.Name,
+				Size: remoteSizes[action.Name],
+				Run: func(ctx context.Context, p *transferProgress) error {
+					var hash string
+					err := writeFileAtomic(path, func(w io.Writer) error {
+						var err error
+						hash, err = client.Download(ctx, action.Name, p.Writer(w))
+						return err
+					})
+					if err != nil {
+						return fmt.Errorf("downloading: %w", err)
+					}
+					done(action, func() { state.Files[action.Name] = hash })
+					return nil
+				},
+			})
+
+		default:
+			others = append(others, action)
+		}
+	}
+
+	errs := []error{runTransfersWith(c.context(), pb, transfers, parallel)}
+
+	conflicts := 0
+	for _, action := range others {
+		switch action.Kind {
+		case syncDeleteRemote:
+			if err := client.DeleteByName(c.context(), action.Name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: deleting: %w", action.Name, err))
+				continue
+			}
+		case syncDeleteLocal:
+			if err := os.Remove(filepath.Join(dir, action.Name)); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		case syncConflict:
+			conflicts++
+		}
+		if action.Kind != syncConflict {
+			delete(state.Files, action.Name)
+		}
+		fmt.Fprintf(c.stdout, "%s %s (%s)\n", action.Kind, action.Name, action.Reason)
+	}
+
+	if conflicts > 0 {
+		errs = append(errs, fmt.Errorf("%d conflicting files were not synced, resolve the conflicts and sync again", conflicts))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanSync(t *testing.T) {
+	local := map[string]string{"same": "1", "new": "2", "changed": "3", "local-changed": "4", "both": "5", "server-deleted": "6"}
+	remote := map[string]string{"same": "1", "changed": "9", "local-changed": "8", "both": "7", "remote-new": "10", "local-deleted": "11"}
+	base := map[string]string{"same": "1", "changed": "3", "local-changed": "8", "both": "0", "server-deleted": "6", "local-deleted": "11"}
+
+	describe := func(actions []syncAction) []string {
+		var lines []string
+		for _, action := range actions {
+			lines = append(lines, fmt.Sprintf("%s %s", action.Kind, action.Name))
+		}
+		return lines
+	}
+
+	assert.Equal(t, []string{
+		"upload both", "upload changed", "upload local-changed", "upload new", "upload server-deleted",
+	}, describe(planSync(local, remote, base, syncOptions{})))
+
+	assert.Equal(t, []string{
+		"upload both", "upload changed", "upload local-changed", "delete remote local-deleted",
+		"upload new", "delete remote remote-new", "upload server-deleted",
+	}, describe(planSync(local, remote, base, syncOptions{Delete: true})))
+
+	assert.Equal(t, []string{
+		"conflict both", "download changed", "upload local-changed", "download local-deleted",
+		"upload new", "download remote-new", "upload server-deleted",
+	}, describe(planSync(local, remote, base, syncOptions{TwoWay: true})))
+
+	assert.Equal(t, []string{
+		"conflict both", "download changed", "upload local-changed", "delete remote local-deleted",
+		"upload new", "download remote-new", "delete local server-deleted",
+	}, describe(planSync(local, remote, base, syncOptions{TwoWay: true, Delete: true})))
+}
+
+func hashOf(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestSyncCommand(t *testing.T) {
+	remote := map[string]string{"old.txt": "old\n", "server.txt": "from server\n"}
+	var requests []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/list":
+			fmt.Fprint(w, "[")
+			i := 0
+			for name, content := range remote {
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+				fmt.Fprintf(w, `{"name":%q,"hash_digest":%q}`, name, hashOf(content))
+				i++
+			}
+			fmt.Fprint(w, "]")
+		case "/update":
+			file, header, err := r.FormFile("files")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			content, _ := io.ReadAll(file)
+			remote[header.Filename] = string(content)
+		case "/download":
+			name := r.URL.Query().Get("name")
+			w.Header().Set("ETag", `"`+hashOf(remote[name])+`"`)
+			fmt.Fprint(w, remote[name])
+		case "/delete":
+			delete(remote, r.URL.Query().Get("name"))
+		}
+	}))
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "draft.tmp"), []byte("draft\n"), 0644)
+	os.WriteFile(filepath.Join(dir, syncIgnoreFile), []byte("# editor files\n*.tmp\n"), 0644)
+
+	// A dry run changes nothing
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"sync", "-dry-run", "-delete", dir}))
+	assert.Equal(t, "would upload notes.txt (new)\nwould delete remote old.txt (missing locally)\nwould delete remote server.txt (missing locally)\n", stdout.String())
+	assert.Len(t, remote, 2)
+
+	c, stdout, _ = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"sync", "-two-way", "-parallel", "1", "-ignore", "old.*", dir}))
+	assert.Equal(t, "upload notes.txt (new)\ndownload server.txt (new)\n", stdout.String())
+	assert.Equal(t, "notes\n", remote["notes.txt"])
+	content, _ := os.ReadFile(filepath.Join(dir, "server.txt"))
+	assert.Equal(t, "from server\n", string(content))
+	assert.NotContains(t, remote, "draft.tmp")
+	assert.NotContains(t, requests, "DELETE /delete")
+
+	// Changing a file on both sides is a conflict
+	remote["notes.txt"] = "server notes\n"
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("local notes\n"), 0644)
+	os.Remove(filepath.Join(dir, "server.txt"))
+
+	c, stdout, stderr := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitFailure, c.run([]string{"sync", "-two-way", "-delete", "-ignore", "old.*", dir}))
+	assert.Equal(t, "conflict notes.txt (changed locally and on the server)\ndelete remote server.txt (deleted locally)\n", stdout.String())
+	assert.True(t, strings.Contains(stderr.String(), "1 conflicting files were not synced"))
+	assert.Equal(t, "server notes\n", remote["notes.txt"])
+	assert.NotContains(t, remote, "server.txt")
+}
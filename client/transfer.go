@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"file_storage_server/storeclient"
+	"golang.org/x/term"
+)
+
+const (
+	defaultParallel   = 4
+	progressBarWidth  = 20
+	progressNameWidth = 24
+	progressInterval  = 100 * time.Millisecond
+)
+
+// transfer is one file sent to or received from the server
+type transfer struct {
+	Name string
+	// Size is the number of bytes to transfer, 0 when unknown
+	Size int64
+	// Run does the transfer. Data must go through the reader or writer
+	// wrappers of p so that progress is shown.
+	Run func(ctx context.Context, p *transferProgress) error
+}
+
+// transferProgress counts the bytes of one transfer
+type transferProgress struct {
+	name string
+	size int64
+	done atomic.Int64
+}
+
+type countingReader struct {
+	r io.Reader
+	p *transferProgress
+}
+
+func (cr countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.p.done.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	p *transferProgress
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.p.done.Add(int64(n))
+	return n, err
+}
+
+// Reader counts the bytes read from r
+func (p *transferProgress) Reader(r io.Reader) io.Reader {
+	return countingReader{r: r, p: p}
+}
+
+// Writer counts the bytes written to w
+func (p *transferProgress) Writer(w io.Writer) io.Writer {
+	return countingWriter{w: w, p: p}
+}
+
+// progressBars draws a bar for every running transfer and one for the
+// whole batch. Lines printed with println appear above the bars.
+type progressBars struct {
+	out   io.Writer
+	start time.Time
+
+	mu       sync.Mutex
+	active   []*transferProgress
+	total    int64
+	finished int64
+	files    int
+	done     int
+	lines    int
+}
+
+// isTerminal reports whether w is a terminal, where progress bars can be
+// redrawn in place
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+func (pb *progressBars) begin(p *transferProgress) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.active = append(pb.active, p)
+}
+
+func (pb *progressBars) end(p *transferProgress) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	for i, active := range pb.active {
+		if active == p {
+			pb.active = append(pb.active[:i], pb.active[i+1:]...)
+			break
+		}
+	}
+	pb.finished += p.done.Load()
+	pb.done++
+}
+
+// println writes a line to w above the bars
+func (pb *progressBars) println(w io.Writer, line string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.clear()
+	fmt.Fprintln(w, line)
+}
+
+// draw replaces the bars drawn last time with the current ones
+func (pb *progressBars) draw() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if pb.out == nil {
+		return
+	}
+	pb.clear()
+
+	lines := renderProgress(pb.active, pb.finished, pb.total, pb.done, pb.files, time.Since(pb.start))
+	for _, line := range lines {
+		fmt.Fprintf(pb.out, "\033[2K%s\n", line)
+	}
+	pb.lines = len(lines)
+}
+
+// clear erases the bars. The caller must hold pb.mu.
+func (pb *progressBars) clear() {
+	if pb.out == nil || pb.lines == 0 {
+		return
+	}
+	fmt.Fprintf(pb.out, "\033[%dA\033[J", pb.lines)
+	pb.lines = 0
+}
+
+// renderProgress formats one line per active transfer and a last line for
+// the whole batch, with throughput and the estimated time left
+func renderProgress(active []*transferProgress, finished int64, total int64, done int, files int, elapsed time.Duration) []string {
+	seconds := elapsed.Seconds()
+	rate := func(n int64) float64 {
+		if seconds <= 0 {
+			return 0
+		}
+		return float64(n) / seconds
+	}
+
+	var lines []string
+	transferred := finished
+	for _, p := range active {
+		n := p.done.Load()
+		transferred += n
+		lines = append(lines, fmt.Sprintf("%-*s %s %10s/s",
+			progressNameWidth, truncateName(p.name, progressNameWidth), progressBar(n, p.size), formatBytes(int64(rate(n)))))
+	}
+
+	summary := fmt.Sprintf("%d/%d files %s %10s/s", done, files, progressBar(transferred, total), formatBytes(int64(rate(transferred))))
+	if speed := rate(transferred); speed > 0 && total > transferred {
+		eta := time.Duration(float64(total-transferred) / speed * float64(time.Second))
+		summary += fmt.Sprintf("  ETA %s", eta.Round(time.Second))
+	}
+	return append(lines, summary)
+}
+
+// progressBar draws a bar with the percentage done, or only the byte count
+// when the size is unknown
+func progressBar(done int64, size int64) string {
+	if size <= 0 {
+		return fmt.Sprintf("%*s %10s", progressBarWidth+2, "", formatBytes(done))
+	}
+	if done > size {
+		done = size
+	}
+	filled := int(done * progressBarWidth / size)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %3d%%", bar, done*100/size)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n)/unit, "KMGT"
+	for value >= unit && len(suffix) > 1 {
+		value /= unit
+		suffix = suffix[1:]
+	}
+	return fmt.Sprintf("%.1f %ciB", value, suffix[0])
+}
+
+func truncateName(name string, width int) string {
+	if len(name) <= width {
+		return name
+	}
+	return "..." + name[len(name)-width+3:]
+}
+
+// runTransfers runs the transfers with at most parallel of them at a time.
+// Progress bars are drawn on out, which may be nil for no bars. Every
+// transfer is attempted, the errors of failed ones are returned together.
+func runTransfers(ctx context.Context, transfers []transfer, parallel int, out io.Writer) error {
+	return runTransfersWith(ctx, &progressBars{out: out, start: time.Now()}, transfers, parallel)
+}
+
+func runTransfersWith(ctx context.Context, pb *progressBars, transfers []transfer, parallel int) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	pb.files = len(transfers)
+	for _, t := range transfers {
+		pb.total += t.Size
+	}
+
+	jobs := make(chan int)
+	errs := make([]error, len(transfers))
+	var wg sync.WaitGroup
+	for i := 0; i < parallel && i < len(transfers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				t := transfers[i]
+				p := &transferProgress{name: t.Name, size: t.Size}
+				pb.begin(p)
+				if err := t.Run(ctx, p); err != nil {
+					errs[i] = fmt.Errorf("%s: %w", t.Name, err)
+				}
+				pb.end(p)
+			}
+		}()
+	}
+
+	stopDrawing := make(chan struct{})
+	drawn := make(chan struct{})
+	go func() {
+		defer close(drawn)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pb.draw()
+			case <-stopDrawing:
+				return
+			}
+		}
+	}()
+
+	for i := range transfers {
+		if ctx.Err() != nil {
+			errs[i] = fmt.Errorf("%s: %w", transfers[i].Name, ctx.Err())
+			continue
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	close(stopDrawing)
+	<-drawn
+	pb.mu.Lock()
+	pb.clear()
+	pb.mu.Unlock()
+
+	return errors.Join(errs...)
+}
+
+// progressOutput returns where progress bars are drawn: stderr when it is a
+// terminal, otherwise nowhere
+func (c *cli) progressOutput() io.Writer {
+	if isTerminal(c.stderr) {
+		return c.stderr
+	}
+	return nil
+}
+
+// uploadTransfers returns a transfer for every local file which sends it
+// with send, stored under its base name
+func uploadTransfers(paths []string, send func(context.Context, storeclient.Upload) error) ([]transfer, error) {
+	var transfers []transfer
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening file '%s': %v", path, err)
+		}
+
+		path := path
+		transfers = append(transfers, transfer{
+			Name: path,
+			Size: info.Size(),
+			Run: func(ctx context.Context, p *transferProgress) error {
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				return send(ctx, storeclient.Upload{Name: filepath.Base(path), Content: p.Reader(file)})
+			},
+		})
+	}
+	return transfers, nil
+}
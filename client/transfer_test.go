@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTransfers(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	var transfers []transfer
+	for i := 0; i < 10; i++ {
+		i := i
+		transfers = append(transfers, transfer{
+			Name: fmt.Sprintf("file%d", i),
+			Size: 3,
+			Run: func(ctx context.Context, p *transferProgress) error {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				io.Copy(io.Discard, p.Reader(strings.NewReader("abc")))
+				if i%4 == 3 {
+					return errors.New("failed")
+				}
+				return nil
+			},
+		})
+	}
+
+	err := runTransfers(context.Background(), transfers, 3, nil)
+
+	assert.Equal(t, int32(3), maxRunning.Load())
+	assert.EqualError(t, err, "file3: failed\nfile7: failed")
+}
+
+func TestRenderProgress(t *testing.T) {
+	assert.Equal(t, "[>                   ]   0%", progressBar(0, 100))
+	assert.Equal(t, "[==========>         ]  50%", progressBar(50, 100))
+	assert.Equal(t, "[====================] 100%", progressBar(150, 100))
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "3.0 MiB", formatBytes(3<<20))
+
+	active := &transferProgress{name: "a-very-long-file-name-for-the-bar.txt", size: 1000}
+	active.done.Store(500)
+	lines := renderProgress([]*transferProgress{active}, 1500, 4000, 1, 3, 2*time.Second)
+
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "...-name-for-the-bar.txt [==========>         ]  50%"), lines[0])
+	assert.Contains(t, lines[0], "250 B/s")
+	assert.Contains(t, lines[1], "1/3 files [==========>         ]  50%")
+	assert.Contains(t, lines[1], "1000 B/s  ETA 2s")
+}
+
+func TestAddUploadsFilesInParallel(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("files")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, _ := io.ReadAll(file)
+		if string(content) == "duplicate" {
+			http.Error(w, "Content of file is already stored in server", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, header.Filename+"="+string(content))
+		mu.Unlock()
+	}))
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+		os.WriteFile(path, []byte(fmt.Sprintf("content %d", i)), 0644)
+		paths = append(paths, path)
+	}
+
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run(append([]string{"add", "-parallel", "2"}, paths...)))
+	assert.Equal(t, "Files created successfully!\n", stdout.String())
+	sort.Strings(received)
+	assert.Equal(t, []string{"file0.txt=content 0", "file1.txt=content 1", "file2.txt=content 2", "file3.txt=content 3", "file4.txt=content 4"}, received)
+
+	// A rejected file does not stop the others
+	received = nil
+	os.WriteFile(paths[0], []byte("duplicate"), 0644)
+	c, _, stderr := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitFailure, c.run(append([]string{"add"}, paths...)))
+	assert.Len(t, received, 4)
+	assert.Contains(t, stderr.String(), "file0.txt: POST /add: 400 Bad Request: Content of file is already stored in server")
+}
+
+func TestGet(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			fmt.Fprint(w, `[{"name":"a.txt","bytes":1},{"name":"b.txt","bytes":1}]`)
+		case "/download":
+			name := r.URL.Query().Get("name")
+			if name == "missing.txt" {
+				http.Error(w, "file not found", http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, strings.TrimSuffix(name, ".txt"))
+		}
+	}))
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitOK, c.run([]string{"get", "-o", dir, "a.txt", "b.txt"}))
+	assert.Equal(t, fmt.Sprintf("Downloaded 2 files to %s\n", dir), stdout.String())
+	content, _ := os.ReadFile(filepath.Join(dir, "b.txt"))
+	assert.Equal(t, "b", string(content))
+
+	// Failed downloads leave no file behind
+	c, _, _ = newTestCLI(mockServer.URL, "")
+	assert.Equal(t, exitFailure, c.run([]string{"get", "-o", dir, "missing.txt"}))
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 2)
+
+	assert.Equal(t, exitUsage, c.run([]string{"get", "../a.txt"}))
+}
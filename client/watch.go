@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"file_storage_server/storeclient"
+	"github.com/fsnotify/fsnotify"
+)
+
+type watchOptions struct {
+	// Debounce is how long a file must stay unchanged before it is pushed,
+	// so that an editor writing a file in several steps causes one upload
+	Debounce time.Duration
+	// Retries is the number of times a failed upload or delete is retried
+	Retries    int
+	RetryWait  time.Duration
+	Ignore     []string
+	KeepRemote bool
+}
+
+// watcher pushes the changes of a directory to the server
+type watcher struct {
+	c      *cli
+	client *storeclient.Client
+	dir    string
+	opts   watchOptions
+
+	// remote holds the hashes of the stored files, to skip uploads of
+	// unchanged content and to choose between add and update
+	remote  map[string]string
+	pending map[string]*time.Timer
+	ready   chan string
+
+	uploaded, deleted, failed int
+}
+
+func runWatch(c *cli, flags *flag.FlagSet, args []string) error {
+	opts := watchOptions{RetryWait: time.Second}
+	flags.DurationVar(&opts.Debounce, "debounce", 500*time.Millisecond, "wait this long after the last change of a file before pushing it")
+	flags.IntVar(&opts.Retries, "retries", 3, "number of times a failed request is retried")
+	flags.BoolVar(&opts.KeepRemote, "keep-remote", false, "do not delete stored files when local files are deleted")
+	flags.Func("ignore", "glob pattern of files to skip, may be repeated", func(pattern string) error {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return err
+		}
+		opts.Ignore = append(opts.Ignore, pattern)
+		return nil
+	})
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageErrorf("expected exactly one directory")
+	}
+	dir := flags.Arg(0)
+
+	patterns, err := readIgnoreFile(dir)
+	if err != nil {
+		return err
+	}
+	opts.Ignore = append(opts.Ignore, patterns...)
+
+	client, err := c.api()
+	if err != nil {
+		return err
+	}
+
+	return c.watch(c.context(), client, dir, opts)
+}
+
+// watch pushes changes of the files in dir until ctx is done. Files are
+// watched by name: when a file changes it is uploaded with add or update,
+// when it disappears it is deleted from the server.
+func (c *cli) watch(ctx context.Context, client *storeclient.Client, dir string, opts watchOptions) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+	if err := fsw.Add(dir); err != nil {
+		return fmt.Errorf("Error watching %s: %v", dir, err)
+	}
+
+	files, err := client.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := &watcher{
+		c:       c,
+		client:  client,
+		dir:     dir,
+		opts:    opts,
+		remote:  map[string]string{},
+		pending: map[string]*time.Timer{},
+		ready:   make(chan string),
+	}
+	for _, file := range files {
+		w.remote[file.Name] = file.HashDigest
+	}
+
+	fmt.Fprintf(c.stdout, "Watching %s for changes, press Ctrl-C to stop\n", dir)
+	for {
+		select {
+		case <-ctx.Done():
+			for _, timer := range w.pending {
+				timer.Stop()
+			}
+			fmt.Fprintf(c.stdout, "Stopped watching: %s\n", w.summary())
+			return nil
+
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			w.schedule(ctx, filepath.Base(event.Name))
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(c.stderr, "store watch: %v\n", err)
+
+		case name := <-w.ready:
+			delete(w.pending, name)
+			w.push(ctx, name)
+		}
+	}
+}
+
+// schedule pushes name once it has not changed for the debounce time. Every
+// kind of event is handled the same way since push looks at the file as it
+// is when the timer fires.
+func (w *watcher) schedule(ctx context.Context, name string) {
+	if isIgnored(name, w.opts.Ignore) {
+		return
+	}
+	if timer, ok := w.pending[name]; ok {
+		timer.Reset(w.opts.Debounce)
+		return
+	}
+	w.pending[name] = time.AfterFunc(w.opts.Debounce, func() {
+		select {
+		case w.ready <- name:
+		case <-ctx.Done():
+		}
+	})
+}
+
+// push uploads or deletes a file so that the server matches the directory
+func (w *watcher) push(ctx context.Context, name string) {
+	path := filepath.Join(w.dir, name)
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, stored := w.remote[name]; !stored || w.opts.KeepRemote {
+			return
+		}
+		err := w.retry(ctx, "delete", name, func() error {
+			return w.client.DeleteByName(ctx, name)
+		})
+		if err == nil || errors.Is(err, storeclient.ErrNotFound) {
+			delete(w.remote, name)
+		}
+		return
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		w.report("upload", name, err)
+		return
+	}
+	hashBytes := sha256.Sum256(content)
+	hash := hex.EncodeToString(hashBytes[:])
+	previous, stored := w.remote[name]
+	if stored && previous == hash {
+		return
+	}
+
+	err = w.retry(ctx, "upload", name, func() error {
+		uploads, closeAll, err := openUploads([]string{path})
+		if err != nil {
+			return err
+		}
+		defer closeAll()
+
+		if !stored {
+			err = w.client.Add(ctx, uploads[0])
+			if !errors.Is(err, storeclient.ErrBadRequest) {
+				return err
+			}
+			// The server refuses to add content it already stores under
+			// another name, update stores it anyway
+			if _, err := uploads[0].Content.(*os.File).Seek(0, 0); err != nil {
+				return err
+			}
+		}
+		return w.client.Update(ctx, uploads[0])
+	})
+	if err == nil {
+		w.remote[name] = hash
+	}
+}
+
+// retry runs op until it succeeds or the retries are used up, waiting
+// longer after every failure, and reports the outcome
+func (w *watcher) retry(ctx context.Context, action string, name string, op func() error) error {
+	wait := w.opts.RetryWait
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= w.opts.Retries || ctx.Err() != nil || !worthRetrying(err) {
+			w.report(action, name, err)
+			return err
+		}
+
+		delay := wait
+		var apiErr *storeclient.APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			delay = apiErr.RetryAfter
+		}
+		fmt.Fprintf(w.c.stderr, "store watch: %s %s failed, retrying in %s: %v\n", action, name, delay, err)
+		select {
+		case <-ctx.Done():
+			w.report(action, name, ctx.Err())
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		wait *= 2
+	}
+}
+
+// worthRetrying reports whether a failed request may succeed when it is
+// sent again, which is not the case when the server rejected it
+func worthRetrying(err error) bool {
+	var apiErr *storeclient.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// report logs the outcome of an action with the running totals
+func (w *watcher) report(action string, name string, err error) {
+	switch {
+	case err != nil:
+		w.failed++
+		fmt.Fprintf(w.c.stderr, "store watch: %s %s failed: %v (%s)\n", action, name, err, w.summary())
+		return
+	case action == "delete":
+		w.deleted++
+	default:
+		w.uploaded++
+	}
+	fmt.Fprintf(w.c.stdout, "%s %s %s (%s)\n", time.Now().Format(time.TimeOnly), action, name, w.summary())
+}
+
+func (w *watcher) summary() string {
+	return fmt.Sprintf("%d uploaded, %d deleted, %d failed", w.uploaded, w.deleted, w.failed)
+}
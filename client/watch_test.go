@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"file_storage_server/storeclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	failures := 1
+	received := make(chan string, 10)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list" {
+			fmt.Fprint(w, `[{"name":"old.txt","hash_digest":"abc"}]`)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/delete" {
+			requests = append(requests, "delete "+r.URL.Query().Get("name"))
+			received <- r.URL.Path
+			return
+		}
+		if failures > 0 {
+			failures--
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		file, header, _ := r.FormFile("files")
+		content, _ := io.ReadAll(file)
+		requests = append(requests, fmt.Sprintf("%s %s %s", r.URL.Path, header.Filename, content))
+		received <- r.URL.Path
+	}))
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "old.txt"), []byte("old"), 0644)
+
+	c, stdout, _ := newTestCLI(mockServer.URL, "")
+	client, _ := storeclient.New(mockServer.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.watch(ctx, client, dir, watchOptions{Debounce: 50 * time.Millisecond, Retries: 1, RetryWait: time.Millisecond, Ignore: []string{"*.swp"}})
+	}()
+
+	wait := func() {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the upload")
+		}
+	}
+
+	// Give the watcher time to start before changing files
+	time.Sleep(100 * time.Millisecond)
+
+	// Rapid writes are pushed once, after a failed attempt is retried
+	path := filepath.Join(dir, "notes.txt")
+	for _, content := range []string{"a", "ab", "abc"} {
+		os.WriteFile(path, []byte(content), 0644)
+	}
+	os.WriteFile(filepath.Join(dir, ".notes.txt.swp"), []byte("swap"), 0644)
+	wait()
+
+	os.WriteFile(filepath.Join(dir, "old.txt"), []byte("new"), 0644)
+	wait()
+
+	os.Remove(path)
+	wait()
+
+	// Let the watcher read the last response before stopping it
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/add notes.txt abc", "/update old.txt new", "delete notes.txt"}, requests)
+	assert.Contains(t, stdout.String(), "Stopped watching: 2 uploaded, 1 deleted, 0 failed")
+}
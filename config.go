@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"file_storage_server/server"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// config holds the settings of the running server. Handlers read their
+// limits from it, tests use the defaults.
+var config = server.DefaultConfig()
+
+// loadConfig builds the server settings from, in increasing order of
+// precedence, the defaults, the config file, the environment and the flags
+// in args. Variables from a .env file in the working directory are added to
+// the environment when they are not already set. printConfig is set by
+// -print-config.
+func loadConfig(args []string, stderr io.Writer) (cfg server.Config, printConfig bool, err error) {
+	flags := flag.NewFlagSet("file_storage_server", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("config", "", "YAML config file, defaults to $STORE_SERVER_CONFIG")
+	flags.BoolVar(&printConfig, "print-config", false, "print the settings with passwords redacted and exit")
+
+	// Flags are parsed into their own Config and only the ones given on the
+	// command line are copied over the other sources
+	var set server.Config
+	flags.StringVar(&set.Listen, "listen", "", "address to listen on, e.g. :2021")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 0, "how long running requests may take to finish when stopping")
+	flags.StringVar(&set.Log.Level, "log-level", "", "debug, info, warn or error")
+	flags.StringVar(&set.Log.Format, "log-format", "", "text or json")
+	flags.StringVar(&set.Tracing.Endpoint, "tracing-endpoint", "", "OTLP/HTTP URL of the collector traces are sent to")
+	flags.Float64Var(&set.Tracing.SampleRatio, "tracing-sample-ratio", 0, "part of the requests traced, from 0 to 1")
+	flags.StringVar(&set.TLS.CertFile, "tls-cert", "", "certificate file, turns on HTTPS")
+	flags.StringVar(&set.TLS.KeyFile, "tls-key", "", "private key file of the certificate")
+	flags.StringVar(&set.TLS.ClientCAFile, "tls-client-ca", "", "CA file to verify client certificates with")
+	flags.StringVar(&set.TLS.ClientAuth, "tls-client-auth", "", "client certificates: none, optional or require")
+	flags.StringVar(&set.Database.Host, "db-host", "", "database host")
+	flags.IntVar(&set.Database.Port, "db-port", 0, "database port")
+	flags.StringVar(&set.Database.User, "db-user", "", "database user, the password is only read from the file or $DB_PASSWORD")
+	flags.StringVar(&set.Database.Name, "db-name", "", "database name")
+	flags.IntVar(&set.Database.MaxOpenConns, "db-max-open-conns", 0, "maximum number of open database connections")
+	flags.Int64Var(&set.Limits.MaxUploadBytes, "max-upload-bytes", 0, "largest upload request accepted")
+	flags.Int64Var(&set.Limits.MultipartMemoryBytes, "multipart-memory-bytes", 0, "part of an upload kept in memory")
+	flags.Int64Var(&set.Limits.MaxPatchBytes, "max-patch-bytes", 0, "largest patch request accepted")
+	grepTimeout := flags.Duration("grep-timeout", 0, "default search timeout")
+	maxGrepTimeout := flags.Duration("max-grep-timeout", 0, "longest search timeout a client may ask for")
+	flags.Float64Var(&set.RateLimit.RequestsPerSecond, "rate-limit", 0, "requests per second a client may send to a route, 0 for no limit")
+	flags.IntVar(&set.RateLimit.Burst, "rate-limit-burst", 0, "requests a client may send at once")
+	trashRetention := flags.Duration("trash-retention", 0, "how long deleted files stay in the trash, 0 to keep them until emptied")
+	flags.BoolVar(&set.Features.Grep, "enable-grep", false, "serve /grep")
+	flags.BoolVar(&set.Features.Diff, "enable-diff", false, "serve /diff")
+	flags.BoolVar(&set.Features.Patch, "enable-patch", false, "serve /patch")
+	flags.BoolVar(&set.Features.Metrics, "enable-metrics", false, "serve /metrics")
+	if err := flags.Parse(args); err != nil {
+		return cfg, false, err
+	}
+	if flags.NArg() > 0 {
+		return cfg, false, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cfg, false, fmt.Errorf("Error loading .env file: %v", err)
+	}
+
+	cfg = server.DefaultConfig()
+	if *configFile == "" {
+		*configFile = os.Getenv("STORE_SERVER_CONFIG")
+	}
+	if *configFile != "" {
+		if err := cfg.LoadFile(*configFile); err != nil {
+			return cfg, false, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.Getenv); err != nil {
+		return cfg, false, err
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = set.Listen
+		case "shutdown-timeout":
+			cfg.Timeouts.Shutdown = server.Duration(*shutdownTimeout)
+		case "log-level":
+			cfg.Log.Level = set.Log.Level
+		case "log-format":
+			cfg.Log.Format = set.Log.Format
+		case "tracing-endpoint":
+			cfg.Tracing.Endpoint = set.Tracing.Endpoint
+		case "tracing-sample-ratio":
+			cfg.Tracing.SampleRatio = set.Tracing.SampleRatio
+		case "tls-cert":
+			cfg.TLS.CertFile = set.TLS.CertFile
+		case "tls-key":
+			cfg.TLS.KeyFile = set.TLS.KeyFile
+		case "tls-client-ca":
+			cfg.TLS.ClientCAFile = set.TLS.ClientCAFile
+		case "tls-client-auth":
+			cfg.TLS.ClientAuth = set.TLS.ClientAuth
+		case "db-host":
+			cfg.Database.Host = set.Database.Host
+		case "db-port":
+			cfg.Database.Port = set.Database.Port
+		case "db-user":
+			cfg.Database.User = set.Database.User
+		case "db-name":
+			cfg.Database.Name = set.Database.Name
+		case "db-max-open-conns":
+			cfg.Database.MaxOpenConns = set.Database.MaxOpenConns
+		case "max-upload-bytes":
+			cfg.Limits.MaxUploadBytes = set.Limits.MaxUploadBytes
+		case "multipart-memory-bytes":
+			cfg.Limits.MultipartMemoryBytes = set.Limits.MultipartMemoryBytes
+		case "max-patch-bytes":
+			cfg.Limits.MaxPatchBytes = set.Limits.MaxPatchBytes
+		case "grep-timeout":
+			cfg.Limits.GrepTimeout = server.Duration(*grepTimeout)
+		case "max-grep-timeout":
+			cfg.Limits.MaxGrepTimeout = server.Duration(*maxGrepTimeout)
+		case "rate-limit":
+			cfg.RateLimit.RequestsPerSecond = set.RateLimit.RequestsPerSecond
+		case "rate-limit-burst":
+			cfg.RateLimit.Burst = set.RateLimit.Burst
+		case "trash-retention":
+			cfg.Trash.Retention = server.Duration(*trashRetention)
+		case "enable-grep":
+			cfg.Features.Grep = set.Features.Grep
+		case "enable-diff":
+			cfg.Features.Diff = set.Features.Diff
+		case "enable-patch":
+			cfg.Features.Patch = set.Features.Patch
+		case "enable-metrics":
+			cfg.Features.Metrics = set.Features.Metrics
+		}
+	})
+
+	// Invalid settings are printed anyway, to help finding where they
+	// come from, and validated afterwards
+	if printConfig {
+		return cfg, true, nil
+	}
+	return cfg, false, cfg.Validate()
+}
+
+// writeConfig prints the settings as a config file, without the password
+func writeConfig(w io.Writer, cfg server.Config) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"file_storage_server/server"
+	"gorm.io/gorm"
+)
+
+const defaultDiffContext = 3
+
+// maxDiffEdits is the largest number of inserted and deleted lines, or
+// words, a diff may have. The search keeps a trace that grows with the
+// square of the number of edits, so very different inputs are refused.
+const maxDiffEdits = 2000
+
+// errDiffTooLarge is returned when two inputs differ by more than
+// maxDiffEdits edits
+var errDiffTooLarge = fmt.Errorf("the inputs differ by more than %d edits", maxDiffEdits)
+
+type editKind byte
+
+const (
+	editEqual  editKind = ' '
+	editDelete editKind = '-'
+	editInsert editKind = '+'
+)
+
+type edit struct {
+	Kind editKind
+	Text string
+	// Number of tokens of a and b that come before this edit
+	A, B int
+}
+
+// diffTokens computes the shortest edit script turning a into b using the
+// Myers algorithm. It returns errDiffTooLarge when the script would have
+// more than maxDiffEdits inserts and deletes.
+func diffTokens(a, b []string) ([]edit, error) {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] keeps the diagonals -d..d of v as they were before round
+	// d, which are the only ones the walk back reads
+	var trace [][]int
+search:
+	for d := 0; d <= max; d++ {
+		if d > maxDiffEdits {
+			return nil, errDiffTooLarge
+		}
+		trace = append(trace, slices.Clone(v[offset-d:offset+d+1]))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back through the trace from the end of both inputs
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		// The first round starts at the beginning of both inputs
+		prevX, prevY := 0, 0
+		if d > 0 {
+			var prevK int
+			if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+				prevK = k + 1
+			} else {
+				prevK = k - 1
+			}
+			prevX = v[prevK+d]
+			prevY = prevX - prevK
+		}
+
+		for x > prevX && y > prevY {
+			edits = append(edits, edit{Kind: editEqual, Text: a[x-1], A: x - 1, B: y - 1})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, edit{Kind: editInsert, Text: b[y-1], A: x, B: y - 1})
+			} else {
+				edits = append(edits, edit{Kind: editDelete, Text: a[x-1], A: x - 1, B: y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits, nil
+}
+
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.Split(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// unifiedDiff writes the difference between two texts in unified diff
+// format with the given number of context lines. Nothing is written when
+// the texts are equal.
+func unifiedDiff(w io.Writer, labelA, labelB string, a, b string, context int) error {
+	edits, err := diffTokens(splitLines(a), splitLines(b))
+	if err != nil {
+		return err
+	}
+
+	var changes []int
+	for i, e := range edits {
+		if e.Kind != editEqual {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", labelA, labelB)
+
+	for i := 0; i < len(changes); {
+		start := changes[i] - context
+		if start < 0 {
+			start = 0
+		}
+
+		// Merge changes whose context would overlap into one hunk
+		last := changes[i]
+		i++
+		for i < len(changes) && changes[i]-last <= 2*context {
+			last = changes[i]
+			i++
+		}
+		end := last + context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		hunk := edits[start:end]
+		countA, countB := 0, 0
+		for _, e := range hunk {
+			if e.Kind != editInsert {
+				countA++
+			}
+			if e.Kind != editDelete {
+				countB++
+			}
+		}
+
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(hunk[0].A, countA), hunkRange(hunk[0].B, countB))
+		for _, e := range hunk {
+			fmt.Fprintf(w, "%c%s\n", e.Kind, e.Text)
+		}
+	}
+	return nil
+}
+
+// hunkRange formats the start,count part of a hunk header. Start is 1-based
+// except for empty ranges, which name the line they follow.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+var wordTokenPattern = regexp.MustCompile(`\s+|\S+`)
+
+// wordDiff writes b with the words removed from a wrapped in [-...-] and
+// the words added in {+...+}, like git diff --word-diff
+func wordDiff(w io.Writer, a, b string) error {
+	edits, err := diffTokens(wordTokenPattern.FindAllString(a, -1), wordTokenPattern.FindAllString(b, -1))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(edits); {
+		kind := edits[i].Kind
+		var run strings.Builder
+		for i < len(edits) && edits[i].Kind == kind {
+			run.WriteString(edits[i].Text)
+			i++
+		}
+
+		switch kind {
+		case editDelete:
+			fmt.Fprintf(w, "[-%s-]", run.String())
+		case editInsert:
+			fmt.Fprintf(w, "{+%s+}", run.String())
+		default:
+			io.WriteString(w, run.String())
+		}
+	}
+	return nil
+}
+
+// loadDiffSide returns the label and content of a stored file, or of one
+// of its revisions when revision is not 0
+func loadDiffSide(db *gorm.DB, name string, revision int) (string, string, error) {
+	file, err := server.GetFileByName(db, name)
+	if err != nil {
+		return "", "", err
+	}
+	if revision == 0 {
+		return name, file.Content, nil
+	}
+
+	fileRevision, err := server.GetRevision(db, file.ID, revision)
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%s@%d", name, revision), fileRevision.Content, nil
+}
+
+// Show the difference between two files or two revisions of a file.
+//
+// Query parameters:
+//   a, b          file names, b defaults to a
+//   rev_a, rev_b  revision numbers, the current content is used when omitted
+//                 or 0
+//   mode          unified (default) or word
+//   context       lines of context for unified diffs, defaults to 3
+func getDiff(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	query := r.URL.Query()
+
+	nameA := query.Get("a")
+	if nameA == "" {
+		http.Error(w, "Missing 'a' parameter", http.StatusBadRequest)
+		return
+	}
+	nameB := query.Get("b")
+	if nameB == "" {
+		nameB = nameA
+	}
+
+	mode := query.Get("mode")
+	if mode != "" && mode != "unified" && mode != "word" {
+		http.Error(w, "Invalid 'mode' parameter. Use 'unified' or 'word'.", http.StatusBadRequest)
+		return
+	}
+
+	context, err := parseNonNegativeInt(r, "context", defaultDiffContext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	revA, err := parseNonNegativeInt(r, "rev_a", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	revB, err := parseNonNegativeInt(r, "rev_b", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	labelA, contentA, err := loadDiffSide(db, nameA, revA)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	labelB, contentB, err := loadDiffSide(db, nameB, revB)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+
+	// Nothing is written until the edits are known, so a diff that is too
+	// large can still be answered with an error
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if mode == "word" {
+		err = wordDiff(w, contentA, contentB)
+	} else {
+		err = unifiedDiff(w, labelA, labelB, contentA, contentB, context)
+	}
+	if errors.Is(err, errDiffTooLarge) {
+		http.Error(w, fmt.Sprintf("Can not diff %s and %s: %v", labelA, labelB, err), http.StatusUnprocessableEntity)
+	}
+}
+
+func writeLookupError(w http.ResponseWriter, err error) {
+	if errors.Is(err, server.ErrFileNotFound) || errors.Is(err, server.ErrRevisionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Error fetching file: %v", err), http.StatusInternalServerError)
+}
+
+type RevisionInfo struct {
+	Revision   int       `json:"revision"`
+	HashDigest string    `json:"hash_digest"`
+	Bytes      int       `json:"bytes"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// List the stored revisions of a file
+func getHistory(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+
+	file, err := server.GetFileByName(db, name)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+
+	revisions, err := server.GetRevisions(db, file.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching revisions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	history := []RevisionInfo{}
+	for _, revision := range revisions {
+		history = append(history, RevisionInfo{
+			Revision:   revision.Revision,
+			HashDigest: revision.HashDigest,
+			Bytes:      len(revision.Content),
+			CreatedAt:  revision.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
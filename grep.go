@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"file_storage_server/server"
+	"gorm.io/gorm"
+)
+
+type grepOptions struct {
+	Before   int
+	After    int
+	MaxCount int
+}
+
+// grepWriter receives the output of a search
+type grepWriter interface {
+	line(name string, number int, text string, match bool)
+	separator()
+	stopped(reason string)
+}
+
+// textGrepWriter writes matches as name:line:text and context lines as
+// name-line-text, with "--" between non-adjacent groups, the same way grep
+// does
+type textGrepWriter struct {
+	w io.Writer
+}
+
+func (t textGrepWriter) line(name string, number int, text string, match bool) {
+	sep := "-"
+	if match {
+		sep = ":"
+	}
+	fmt.Fprintf(t.w, "%s%s%d%s%s\n", name, sep, number, sep, text)
+}
+
+func (t textGrepWriter) separator() {
+	fmt.Fprintln(t.w, "--")
+}
+
+func (t textGrepWriter) stopped(reason string) {
+	fmt.Fprintf(t.w, "grep: %s\n", reason)
+}
+
+// GrepLine is one line of output with format=json, written as one JSON
+// object per line
+type GrepLine struct {
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Match     bool   `json:"match,omitempty"`
+	Separator bool   `json:"separator,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type jsonGrepWriter struct {
+	enc *json.Encoder
+}
+
+func (j jsonGrepWriter) line(name string, number int, text string, match bool) {
+	j.enc.Encode(GrepLine{File: name, Line: number, Text: text, Match: match})
+}
+
+func (j jsonGrepWriter) separator() {
+	j.enc.Encode(GrepLine{Separator: true})
+}
+
+func (j jsonGrepWriter) stopped(reason string) {
+	j.enc.Encode(GrepLine{Error: reason})
+}
+
+// grepContent writes every line of content matching re, with the requested
+// context lines, to w. remaining is decremented for each match; when it
+// reaches zero the search stops. A negative value means no limit.
+func grepContent(ctx context.Context, w grepWriter, name string, content string, re *regexp.Regexp, opts grepOptions, remaining *int) error {
+	lines := strings.Split(content, "\n")
+	// Drop the empty element produced by a trailing newline
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	lastPrinted := -1
+	afterLeft := 0
+
+	for i, line := range lines {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if *remaining == 0 && afterLeft == 0 {
+			return nil
+		}
+
+		if *remaining != 0 && re.MatchString(line) {
+			start := i - opts.Before
+			if start <= lastPrinted {
+				start = lastPrinted + 1
+			}
+			if start < 0 {
+				start = 0
+			}
+			if lastPrinted >= 0 && start > lastPrinted+1 {
+				w.separator()
+			}
+			for j := start; j < i; j++ {
+				w.line(name, j+1, lines[j], false)
+			}
+			w.line(name, i+1, line, true)
+			lastPrinted = i
+			afterLeft = opts.After
+			if *remaining > 0 {
+				*remaining--
+			}
+			continue
+		}
+
+		if afterLeft > 0 {
+			w.line(name, i+1, line, false)
+			lastPrinted = i
+			afterLeft--
+		}
+	}
+
+	return nil
+}
+
+// flushWriter flushes the response after every write so matches are
+// streamed to the client as soon as they are found
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+func parseNonNegativeInt(r *http.Request, key string, fallback int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid '%s' parameter", key)
+	}
+	return n, nil
+}
+
+// Search stored files with a regular expression
+func getGrep(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	query := r.URL.Query()
+
+	pattern := query.Get("pattern")
+	if pattern == "" {
+		http.Error(w, "Missing 'pattern' parameter", http.StatusBadRequest)
+		return
+	}
+	if ignoreCase, _ := strconv.ParseBool(query.Get("ignore_case")); ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid 'pattern' parameter: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var opts grepOptions
+	contextLines, err := parseNonNegativeInt(r, "context", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Before, err = parseNonNegativeInt(r, "before", contextLines); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.After, err = parseNonNegativeInt(r, "after", contextLines); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.MaxCount, err = parseNonNegativeInt(r, "max", 0); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout := time.Duration(config.Limits.GrepTimeout)
+	if timeoutStr := query.Get("timeout"); timeoutStr != "" {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 {
+			http.Error(w, "Invalid 'timeout' parameter", http.StatusBadRequest)
+			return
+		}
+		if maxTimeout := time.Duration(config.Limits.MaxGrepTimeout); timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "text" && format != "json" {
+		http.Error(w, "Invalid 'format' parameter. Use 'text' or 'json'.", http.StatusBadRequest)
+		return
+	}
+
+	var files []server.File
+	if names := query["file"]; len(names) > 0 {
+		files, err = server.GetFilesByNames(db, names)
+	} else {
+		files, err = server.GetFiles(db)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching files: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	include := query.Get("include")
+	if include != "" {
+		if _, err := path.Match(include, ""); err != nil {
+			http.Error(w, "Invalid 'include' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	flusher, _ := w.(http.Flusher)
+	out := bufio.NewWriter(flushWriter{w: w, f: flusher})
+	defer out.Flush()
+
+	var results grepWriter = textGrepWriter{w: out}
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		results = jsonGrepWriter{enc: json.NewEncoder(out)}
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	remaining := -1
+	if opts.MaxCount > 0 {
+		remaining = opts.MaxCount
+	}
+
+	for _, file := range files {
+		if include != "" {
+			if ok, _ := path.Match(include, file.Name); !ok {
+				continue
+			}
+		}
+
+		err := grepContent(ctx, results, file.Name, file.Content, re, opts, &remaining)
+		if err != nil {
+			results.stopped(fmt.Sprintf("search stopped after %s: %v", timeout, err))
+			return
+		}
+		if remaining == 0 {
+			return
+		}
+		out.Flush()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"file_storage_server/server"
+	"gorm.io/gorm"
+)
+
+// readinessTimeout limits how long the checks of /readyz may take together
+const readinessTimeout = 5 * time.Second
+
+// healthCheck is a dependency the server needs to serve requests
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// checkResult is the outcome of a healthCheck in the /readyz response
+type checkResult struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+type healthResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks,omitempty"`
+}
+
+const (
+	statusOK          = "ok"
+	statusFailed      = "failed"
+	statusUnavailable = "unavailable"
+)
+
+// readinessChecks are the dependencies checked by /readyz: the database,
+// its tables, whether it accepts writes, and the temporary directory
+// large uploads are spooled to
+func readinessChecks(db *gorm.DB) []healthCheck {
+	return []healthCheck{
+		{"database", func(ctx context.Context) error { return server.PingDatabase(ctx, db) }},
+		{"migrations", func(ctx context.Context) error { return server.CheckMigrations(ctx, db) }},
+		{"storage", func(ctx context.Context) error { return server.CheckWritable(ctx, db) }},
+		{"temp_dir", func(context.Context) error { return checkTempDir() }},
+	}
+}
+
+// checkTempDir checks that a file can be written to the directory where
+// multipart uploads larger than limits.multipart_memory_bytes are kept
+func checkTempDir() error {
+	f, err := os.CreateTemp("", "readyz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeHealth(w http.ResponseWriter, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// getHealthz answers liveness probes. It does not check dependencies, since
+// restarting the server does not bring the database back.
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthResponse{Status: statusOK})
+}
+
+// getReadyz answers readiness probes. The checks run concurrently and the
+// server is ready when all of them pass; otherwise it answers 503 with the
+// error of every failed check.
+func getReadyz(checks []healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		response := healthResponse{Status: statusOK, Checks: make([]checkResult, len(checks))}
+		var wg sync.WaitGroup
+		for i, hc := range checks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				err := hc.check(ctx)
+				result := checkResult{Name: hc.name, Status: statusOK, DurationSeconds: time.Since(start).Seconds()}
+				if err != nil {
+					result.Status = statusFailed
+					result.Error = err.Error()
+				}
+				response.Checks[i] = result
+			}()
+		}
+		wg.Wait()
+
+		for _, result := range response.Checks {
+			if result.Status != statusOK {
+				response.Status = statusUnavailable
+			}
+		}
+		writeHealth(w, response)
+	}
+}
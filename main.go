@@ -1,19 +1,30 @@
 package main
 
 import (
+    "context"
     "crypto/sha256"
+    "crypto/tls"
     "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
     "fmt"
     "io"
-    "log"
+    "log/slog"
+    "net"
     "net/http"
     "os"
+    "os/signal"
     "sort"
     "strconv"
     "strings"
+    "syscall"
     "time"
 
     "file_storage_server/server"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
     "gorm.io/gorm"
 )
 
@@ -22,17 +33,56 @@ type WordCount struct {
     Count int    `json:"count"`
 }
 
+type FileInfo struct {
+    ID         int       `json:"id"`
+    Name       string    `json:"name"`
+    HashDigest string    `json:"hash_digest"`
+    Bytes      int       `json:"bytes"`
+    CreatedAt  time.Time `json:"created_at"`
+    UpdatedAt  time.Time `json:"updated_at"`
+}
+
 
 // Simple function to ping and test if server is up or not
 func getPing(w http.ResponseWriter, r *http.Request) {
-    fmt.Printf("pong!\n")
     io.WriteString(w, "pong working!")
 }
 
+// parseUploadForm parses the multipart form of an upload within the
+// configured limits. On failure it answers with 413 when the upload is too
+// large, otherwise with 400 and the missing message, and returns false.
+func parseUploadForm(w http.ResponseWriter, r *http.Request, missing string) bool {
+    _, span := server.StartSpan(r.Context(), "parse multipart form")
+    r.Body = http.MaxBytesReader(w, r.Body, config.Limits.MaxUploadBytes)
+    err := r.ParseMultipartForm(config.Limits.MultipartMemoryBytes)
+    server.EndSpan(span, err)
+
+    var tooLarge *http.MaxBytesError
+    switch {
+    case errors.As(err, &tooLarge):
+        http.Error(w, fmt.Sprintf("Upload is larger than the limit of %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+        return false
+    case err != nil:
+        http.Error(w, missing, http.StatusBadRequest)
+        return false
+    }
+    return true
+}
+
+// hashContent returns the SHA-256 digest of content, which identifies it
+// for deduplication
+func hashContent(ctx context.Context, content []byte) string {
+    _, span := server.StartSpan(ctx, "hash content", trace.WithAttributes(attribute.Int("bytes", len(content))))
+    defer span.End()
+    hashDigest := sha256.Sum256(content)
+    return hex.EncodeToString(hashDigest[:])
+}
+
 // Save files in DB
 func postFiles(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
-    r.ParseMultipartForm(10 << 20) 
-
+    if !parseUploadForm(w, r, "Missing 'files' parameter") {
+        return
+    }
     files := r.MultipartForm.File["files"]
 
     for _, fileHeader := range files {
@@ -49,10 +99,12 @@ func postFiles(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
             return
         }
 
-        hashDigest := sha256.Sum256(fileContent)
-        hashString := hex.EncodeToString(hashDigest[:])
+        hashString := hashContent(r.Context(), fileContent)
 
-        err = server.CheckDuplicateHash(db, hashString)
+        ctx, span := server.StartSpan(r.Context(), "check duplicate")
+        err = server.CheckDuplicateHash(db.WithContext(ctx), hashString)
+        span.SetAttributes(attribute.Bool("duplicate", err != nil))
+        span.End()
         if err != nil {
             http.Error(w, fmt.Sprintf("Content of file %s is already stored in server", fileHeader.Filename), http.StatusBadRequest)
             return
@@ -77,8 +129,14 @@ func postFiles(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
     fmt.Fprintln(w, "Files uploaded successfully")
 }
 
-// Get list of files
+// Get list of files, as text or as JSON with format=json
 func getFiles(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+    format := r.URL.Query().Get("format")
+    if format != "" && format != "text" && format != "json" {
+        http.Error(w, "Invalid 'format' parameter. Use 'text' or 'json'.", http.StatusBadRequest)
+        return
+    }
+
     // Fetch all files from the database
     files, err := server.GetFiles(db)
     if err != nil {
@@ -86,14 +144,43 @@ func getFiles(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
         return
     }
 
+    if format == "json" {
+        infos := []FileInfo{}
+        for _, file := range files {
+            infos = append(infos, FileInfo{
+                ID:         file.ID,
+                Name:       file.Name,
+                HashDigest: file.HashDigest,
+                Bytes:      len(file.Content),
+                CreatedAt:  file.CreatedAt,
+                UpdatedAt:  file.UpdatedAt,
+            })
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(infos)
+        return
+    }
+
     for _, file := range files {
         fmt.Fprintf(w, "File ID: %d, Name: %s \n", file.ID, file.Name)
     }
 }
 
-// Delete file
+// Move the files with the content of the uploaded files, or the file named
+// by the 'name' parameter, to the trash
 func deleteFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
-    r.ParseMultipartForm(10 << 20)
+    if name := r.URL.Query().Get("name"); name != "" {
+        if err := server.DeleteFileByName(db, name); err != nil {
+            writeLookupError(w, err)
+            return
+        }
+        fmt.Fprintln(w, "File deleted successfully")
+        return
+    }
+
+    if !parseUploadForm(w, r, "Missing 'files' or 'name' parameter") {
+        return
+    }
     files := r.MultipartForm.File["files"]
 
     for _, fileHeader := range files {
@@ -111,8 +198,7 @@ func deleteFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
             return
         }
 
-        hashDigest := sha256.Sum256(fileContent)
-        hashString := hex.EncodeToString(hashDigest[:])
+        hashString := hashContent(r.Context(), fileContent)
 
         err = server.DeleteFile(db, hashString)
         if err != nil {
@@ -124,9 +210,31 @@ func deleteFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
     fmt.Fprintln(w, "File deleted successfully")
 }
 
+// Send the content of a file, with its hash as the ETag
+func downloadFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+    name := r.URL.Query().Get("name")
+    if name == "" {
+        http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+        return
+    }
+
+    file, err := server.GetFileByName(db, name)
+    if err != nil {
+        writeLookupError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Header().Set("ETag", `"`+file.HashDigest+`"`)
+    w.Header().Set("Content-Length", strconv.Itoa(len(file.Content)))
+    io.WriteString(w, file.Content)
+}
+
 // Update a file if it exists otherwise create a new file
 func putFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
-    r.ParseMultipartForm(10 << 20)
+    if !parseUploadForm(w, r, "Missing 'files' parameter") {
+        return
+    }
     files := r.MultipartForm.File["files"]
 
     for _, fileHeader := range files {
@@ -144,8 +252,7 @@ func putFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
             return
         }
 
-        hashDigest := sha256.Sum256(fileContent)
-        hashString := hex.EncodeToString(hashDigest[:])
+        hashString := hashContent(r.Context(), fileContent)
 
         existingFile, err := server.GetFileByName(db, fileHeader.Filename)
 
@@ -182,7 +289,8 @@ func putFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
     fmt.Fprintln(w, "Files uploaded successfully")
 }
 
-// Fetch word count
+// Fetch word count. Words are split on any white space, like in /fw and
+// /stats, so the count is the sum of the counts of the ranked words.
 func getWordCount(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
     content, err := server.FetchContentAllFile(db)
     if err != nil {
@@ -190,125 +298,263 @@ func getWordCount(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
         return
     }
 
-    wc := len(strings.Split(content, " "))
+    wc := len(strings.Fields(content))
     fmt.Fprintf(w, "All files contain %d words \n", wc)
 }
 
-// Fetch frequent words
-func getFreqWord(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
-    limitStr := r.URL.Query().Get("limit")
-    order := r.URL.Query().Get("order")
+// rankWords counts the words in content and orders them by count, most
+// frequent first when descending is true and least frequent first otherwise.
+// Words with the same count are always ordered lexicographically, so the
+// ranking is the same on every call for the same content.
+func rankWords(content string, descending bool) []WordCount {
+    wordCounts := make(map[string]int)
 
-    limit := 5
+    // Count frequency of each word
+    for _, word := range strings.Fields(content) {
+        wordCounts[word]++
+    }
 
-    fmt.Println(limitStr, order)
+    wordCountList := make([]WordCount, 0, len(wordCounts))
+    for word, count := range wordCounts {
+        wordCountList = append(wordCountList, WordCount{
+            Word:  word,
+            Count: count,
+        })
+    }
 
-    if limitStr != "" {
-        fmt.Println(limitStr, order)
+    sort.Slice(wordCountList, func(i, j int) bool {
+        a, b := wordCountList[i], wordCountList[j]
+        if a.Count != b.Count {
+            if descending {
+                return a.Count > b.Count
+            }
+            return a.Count < b.Count
+        }
+        return a.Word < b.Word
+    })
 
-        parsedLimit, err := strconv.Atoi(limitStr)
-        fmt.Println("helolsosbfk", err)
+    return wordCountList
+}
 
-        if err != nil {
-            http.Error(w, "Invalid 'limit' parameter", http.StatusBadRequest)
-            return
-        }
-        limit = parsedLimit
+// paginate returns at most limit entries starting at offset. The limit is
+// clamped before it is added, so that huge values do not overflow.
+func paginate(list []WordCount, offset int, limit int) []WordCount {
+    if offset > len(list) {
+        offset = len(list)
+    }
+    if limit > len(list)-offset {
+        limit = len(list) - offset
     }
+    return list[offset : offset+limit]
+}
 
-    fmt.Println("ordering now")
+// Fetch frequent words.
+//
+// Query parameters:
+//   order   desc (or dsc) for the most frequent words, asc for the least
+//           frequent. Defaults to desc.
+//   limit   number of words to return, defaults to 5
+//   offset  number of ranked words to skip, defaults to 0
+//   format  text (default) or json
+func getFreqWord(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+    query := r.URL.Query()
 
-    if order != "asc" && order != "dsc" {
-        http.Error(w, "Invalid 'order' parameter. Use 'asc' or 'dsc'.", http.StatusBadRequest)
+    limit, err := parseNonNegativeInt(r, "limit", 5)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
 
-    content, err := server.FetchContentAllFile(db)
+    offset, err := parseNonNegativeInt(r, "offset", 0)
     if err != nil {
-        http.Error(w, fmt.Sprintf("Error fetching files: %v", err), http.StatusInternalServerError)
+        http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
 
-    fmt.Println("files fetched now")
-
-
-    words := strings.Split(content, " ")
-    wordCounts := make(map[string]int)
+    var descending bool
+    switch query.Get("order") {
+    case "", "desc", "dsc":
+        descending = true
+    case "asc":
+        descending = false
+    default:
+        http.Error(w, "Invalid 'order' parameter. Use 'asc' or 'desc'.", http.StatusBadRequest)
+        return
+    }
 
-    // Count frequency of each word
-    for _, word := range words {
-        wordCounts[word]++
+    format := query.Get("format")
+    if format != "" && format != "text" && format != "json" {
+        http.Error(w, "Invalid 'format' parameter. Use 'text' or 'json'.", http.StatusBadRequest)
+        return
     }
 
-    var wordCountList []WordCount
-    for word, count := range wordCounts {
-        wordCountList = append(wordCountList, WordCount{
-            Word:  word,
-            Count: count,
-        })
+    content, err := server.FetchContentAllFile(db)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error fetching files: %v", err), http.StatusInternalServerError)
+        return
     }
 
-    fmt.Println("counting now")
+    page := paginate(rankWords(content, descending), offset, limit)
 
-    var ordering string
-    if order == "dsc" {
-        sort.Slice(wordCountList, func(i, j int) bool {
-            return wordCountList[i].Count > wordCountList[j].Count
-        })
-        ordering = "most"
-    } else {
-        sort.Slice(wordCountList, func(i, j int) bool {
-            return wordCountList[i].Count < wordCountList[j].Count
-        })
-        ordering = "least"
+    if format == "json" {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(page)
+        return
     }
 
-    fmt.Println("sorting now")
+    ordering := "most"
+    if !descending {
+        ordering = "least"
+    }
 
+    fmt.Fprintf(w, "The %d %s frequent words are:\n", len(page), ordering)
+    for _, wc := range page {
+        fmt.Fprintf(w, "%s %d\n", wc.Word, wc.Count)
+    }
+}
 
-    if limit > len(wordCountList) {
-        limit = len(wordCountList)
+// newMux registers the handlers of the enabled features. Their requests are
+// recorded in the metrics and traced, and the API routes are rate limited.
+// Handlers get a session of db bound to the request's context, so that
+// queries are canceled with the request, logged with its ID and traced as
+// part of it, and changes are audited with its client.
+func newMux(db *gorm.DB) *http.ServeMux {
+    mux := http.NewServeMux()
+    route := func(pattern string, handler http.Handler) {
+        mux.Handle(pattern, instrument(pattern, traceRoute(pattern, handler)))
+    }
+    limits := newThrottle(config.RateLimit)
+    handle := func(pattern string, handler func(http.ResponseWriter, *http.Request, *gorm.DB)) {
+        route(pattern, limits.limit(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            ctx := server.ContextWithClient(r.Context(), server.Client{User: requestUser(r), IP: remoteIP(r)})
+            handler(w, r, db.WithContext(ctx))
+        })))
     }
 
-    fmt.Fprintf(w, "The %d %s frequent words are:\n", limit, ordering)
-    for _, wc := range wordCountList[:limit] {
-        fmt.Fprintf(w, "%s\n", wc.Word)
+    route("/ping", http.HandlerFunc(getPing))
+    route("/healthz", http.HandlerFunc(getHealthz))
+    route("/readyz", getReadyz(readinessChecks(db)))
+    handle("/add", postFiles)
+    handle("/list", getFiles)
+    handle("/delete", deleteFile)
+    handle("/download", downloadFile)
+    handle("/update", putFile)
+    handle("/wc", getWordCount)
+    handle("/fw", getFreqWord)
+    handle("/stats", getStats)
+    handle("/history", getHistory)
+    handle("/audit", getAudit)
+    handle("/trash", trash)
+    handle("/trash/restore", restoreFile)
+    if config.Features.Grep {
+        handle("/grep", getGrep)
     }
+    if config.Features.Diff {
+        handle("/diff", getDiff)
+    }
+    if config.Features.Patch {
+        handle("/patch", patchFile)
+    }
+    if config.Features.Metrics {
+        mux.Handle("/metrics", promhttp.Handler())
+    }
+    return mux
+}
+
+// fatal logs an error that prevents the server from running and exits
+func fatal(msg string, err error) {
+    slog.Error(msg, "error", err)
+    os.Exit(1)
 }
 
 func main() {
-    db, err := server.ConnectToDatabase()
+    cfg, printConfig, err := loadConfig(os.Args[1:], os.Stderr)
+    if errors.Is(err, flag.ErrHelp) {
+        return
+    }
+    if printConfig {
+        if err := writeConfig(os.Stdout, cfg); err != nil {
+            fatal("cannot print the configuration", err)
+        }
+        err = cfg.Validate()
+    }
     if err != nil {
-        log.Fatalf("Error: %v", err)
+        fatal("invalid configuration", err)
+    }
+    if printConfig {
+        return
     }
-    fmt.Printf("DB connected\n")
+    config = cfg
 
-    http.HandleFunc("/ping", getPing)
-    http.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
-        postFiles(w, r, db)
-    })
-    http.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
-        getFiles(w, r, db)
-    })
-    http.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
-        deleteFile(w, r, db)
-    })
-    http.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
-        putFile(w, r, db)
-    })
-    http.HandleFunc("/wc", func(w http.ResponseWriter, r *http.Request) {
-        getWordCount(w, r, db)
-    })
-    http.HandleFunc("/fw", func(w http.ResponseWriter, r *http.Request) {
-        getFreqWord(w, r, db)
-    })
+    logger, err := newLogger(config.Log, os.Stderr)
+    if err != nil {
+        fatal("invalid configuration", err)
+    }
+    slog.SetDefault(logger)
+
+    shutdownTracing, err := setupTracing(config.Tracing)
+    if err != nil {
+        fatal("cannot set up tracing", err)
+    }
 
+    tlsConfig, err := newTLSConfig(config.TLS)
+    if err != nil {
+        fatal("cannot load the TLS settings", err)
+    }
+
+    db, err := server.ConnectToDatabase(config.Database)
+    if err != nil {
+        fatal("cannot connect to the database", err)
+    }
+    slog.Info("database connected", "host", config.Database.Host, "name", config.Database.Name)
 
-    err = http.ListenAndServe(":2021", nil)
+    if err := server.Migrate(db); err != nil {
+        fatal("cannot migrate the database", err)
+    }
+    if config.Features.Metrics {
+        if err := server.RegisterMetrics(db, config.Database.Name); err != nil {
+            fatal("cannot register the database metrics", err)
+        }
+    }
 
+    listener, err := net.Listen("tcp", config.Listen)
     if err != nil {
-        fmt.Printf("Error starting in server: %s\n", err)
-        os.Exit(1)
+        fatal("cannot listen", err)
+    }
+    scheme := "http"
+    if tlsConfig != nil {
+        listener = tls.NewListener(listener, tlsConfig)
+        scheme = "https"
+    }
+    slog.Info("listening", "address", fmt.Sprintf("%s://%s", scheme, listener.Addr()))
+
+    // SIGTERM is sent by service managers and container runtimes on deploy.
+    // A second signal kills the server without waiting.
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-ctx.Done()
+        stop()
+        slog.Info("shutting down, waiting for running requests", "timeout", config.Timeouts.Shutdown.String())
+    }()
+
+    if config.Trash.Retention > 0 {
+        go purgeTrash(ctx, db, time.Duration(config.Trash.Retention))
     }
 
-}
\ No newline at end of file
+    handler := accessLog(authenticateClients(newMux(db), config.TLS.ClientUsers))
+    srv := newHTTPServer(config, handler)
+    srv.TLSConfig = tlsConfig
+    err = serve(ctx, srv, listener, time.Duration(config.Timeouts.Shutdown))
+    if closeErr := server.CloseDatabase(db); closeErr != nil {
+        slog.Error("cannot close the database", "error", closeErr)
+    }
+    flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    if flushErr := shutdownTracing(flushCtx); flushErr != nil {
+        slog.Error("cannot send the last traces", "error", flushErr)
+    }
+    cancel()
+    if err != nil {
+        fatal("cannot stop the server cleanly", err)
+    }
+    slog.Info("server stopped")
+}
@@ -1,12 +1,47 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"file_storage_server/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
 )
 
 func TestGetPing(t *testing.T) {
@@ -31,3 +66,1091 @@ func TestGetPing(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected status code 200")
 	assert.Equal(t, "pong working!", string(body), "Expected response body to be 'pong working!'")
 }
+
+func TestGrepContent(t *testing.T) {
+	content := "alpha\nbeta\ngamma\ndelta\nepsilon\nzeta\n"
+	re := regexp.MustCompile("^(beta|zeta)$")
+
+	var out strings.Builder
+	remaining := -1
+	err := grepContent(context.Background(), textGrepWriter{w: &out}, "a.txt", content, re, grepOptions{Before: 1, After: 1}, &remaining)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt-1-alpha\na.txt:2:beta\na.txt-3-gamma\n--\na.txt-5-epsilon\na.txt:6:zeta\n", out.String())
+}
+
+func TestGrepContentMaxCount(t *testing.T) {
+	content := "one match\ntwo match\nthree match\n"
+	re := regexp.MustCompile("(?i)MATCH")
+
+	var out strings.Builder
+	remaining := 2
+	err := grepContent(context.Background(), textGrepWriter{w: &out}, "b.txt", content, re, grepOptions{}, &remaining)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, remaining)
+	assert.Equal(t, "b.txt:1:one match\nb.txt:2:two match\n", out.String())
+}
+
+func TestGrepContentCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var out strings.Builder
+	remaining := -1
+	err := grepContent(ctx, textGrepWriter{w: &out}, "c.txt", "text", regexp.MustCompile("text"), grepOptions{}, &remaining)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, out.String())
+}
+
+func TestGrepContentJSON(t *testing.T) {
+	var out strings.Builder
+	remaining := -1
+	err := grepContent(context.Background(), jsonGrepWriter{enc: json.NewEncoder(&out)}, "my-file-2-x.txt", "a\nb\n", regexp.MustCompile("b"), grepOptions{Before: 1}, &remaining)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"file":"my-file-2-x.txt","line":1,"text":"a"}
+{"file":"my-file-2-x.txt","line":2,"text":"b","match":true}
+`, out.String())
+}
+
+func TestGetGrepInvalidPattern(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/grep?pattern=(", nil)
+	rec := httptest.NewRecorder()
+
+	getGrep(rec, req, nil)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestComputeStats(t *testing.T) {
+	files := []server.File{
+		{Name: "b.txt", Content: "The cat saw the dog.\nThe end\n"},
+		{Name: "a.txt", Content: "héllo world\n"},
+	}
+
+	stats := computeStats(files)
+
+	assert.Len(t, stats.Files, 2)
+	assert.Equal(t, TextStats{
+		Name:               "a.txt",
+		Lines:              1,
+		Words:              2,
+		Characters:         12,
+		Bytes:              13,
+		AverageWordLength:  5,
+		UniqueWords:        2,
+		VocabularyRichness: 1,
+		ReadingTimeSeconds: 1,
+	}, stats.Files[0])
+	assert.Equal(t, "b.txt", stats.Files[1].Name)
+	assert.Equal(t, 2, stats.Files[1].Lines)
+	assert.Equal(t, 7, stats.Files[1].Words)
+	// "the" appears three times and is only counted once
+	assert.Equal(t, 5, stats.Files[1].UniqueWords)
+	assert.Equal(t, 0.71, stats.Files[1].VocabularyRichness)
+
+	assert.Equal(t, "", stats.Total.Name)
+	assert.Equal(t, 3, stats.Total.Lines)
+	assert.Equal(t, 9, stats.Total.Words)
+	assert.Equal(t, 7, stats.Total.UniqueWords)
+	assert.Equal(t, 3, stats.Total.ReadingTimeSeconds)
+}
+
+func TestComputeStatsEmpty(t *testing.T) {
+	stats := computeStats(nil)
+
+	assert.Empty(t, stats.Files)
+	assert.Equal(t, TextStats{}, stats.Total)
+}
+
+func TestRankWordsDescending(t *testing.T) {
+	content := "b a c b a d\nc b"
+
+	// Map iteration order is random, repeat to make sure ties never flicker
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, []WordCount{
+			{Word: "b", Count: 3},
+			{Word: "a", Count: 2},
+			{Word: "c", Count: 2},
+			{Word: "d", Count: 1},
+		}, rankWords(content, true))
+	}
+}
+
+func TestRankWordsAscending(t *testing.T) {
+	content := "b a c b a d\nc b"
+
+	assert.Equal(t, []WordCount{
+		{Word: "d", Count: 1},
+		{Word: "a", Count: 2},
+		{Word: "c", Count: 2},
+		{Word: "b", Count: 3},
+	}, rankWords(content, false))
+}
+
+func TestRankWordsEmpty(t *testing.T) {
+	assert.Empty(t, rankWords("", true))
+	assert.Empty(t, rankWords("  \n ", false))
+}
+
+func TestPaginate(t *testing.T) {
+	list := rankWords("a b b c c c d d d d", true)
+
+	assert.Equal(t, []WordCount{{Word: "d", Count: 4}, {Word: "c", Count: 3}}, paginate(list, 0, 2))
+	assert.Equal(t, []WordCount{{Word: "b", Count: 2}, {Word: "a", Count: 1}}, paginate(list, 2, 5))
+	assert.Empty(t, paginate(list, 10, 5))
+	assert.Empty(t, paginate(list, 0, 0))
+
+	// offset=1&limit=9223372036854775807 returns the tail of the ranking
+	// rather than overflowing
+	assert.Equal(t, list[1:], paginate(list, 1, math.MaxInt))
+	assert.Empty(t, paginate(list, math.MaxInt, math.MaxInt))
+}
+
+// contentsDB returns a database whose queries all answer the given file
+// contents, for handlers that read every stored file
+func contentsDB(t *testing.T, contents ...string) *gorm.DB {
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		Conn:                      sql.OpenDB(contentsConnector{contents}),
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{DisableAutomaticPing: true})
+	assert.NoError(t, err)
+	return db
+}
+
+type contentsConnector struct {
+	contents []string
+}
+
+func (c contentsConnector) Connect(context.Context) (driver.Conn, error) { return contentsConn(c), nil }
+func (c contentsConnector) Driver() driver.Driver                        { return nil }
+
+type contentsConn struct {
+	contents []string
+}
+
+func (c contentsConn) Prepare(string) (driver.Stmt, error) { return contentsStmt(c), nil }
+func (c contentsConn) Close() error                        { return nil }
+func (c contentsConn) Begin() (driver.Tx, error)           { return nil, errors.New("read only") }
+
+type contentsStmt struct {
+	contents []string
+}
+
+func (s contentsStmt) Close() error  { return nil }
+func (s contentsStmt) NumInput() int { return -1 }
+func (s contentsStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("read only")
+}
+func (s contentsStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &contentsRows{contents: s.contents}, nil
+}
+
+type contentsRows struct {
+	contents []string
+}
+
+func (r *contentsRows) Columns() []string { return []string{"content"} }
+func (r *contentsRows) Close() error      { return nil }
+func (r *contentsRows) Next(dest []driver.Value) error {
+	if len(r.contents) == 0 {
+		return io.EOF
+	}
+	dest[0], r.contents = r.contents[0], r.contents[1:]
+	return nil
+}
+
+func TestGetWordCount(t *testing.T) {
+	tests := []struct {
+		contents []string
+		want     string
+	}{
+		{nil, "All files contain 0 words \n"},
+		{[]string{"one two\nthree\tfour  five\n"}, "All files contain 5 words \n"},
+		{[]string{"a b", "b c\n"}, "All files contain 4 words \n"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		getWordCount(rec, httptest.NewRequest(http.MethodGet, "/wc", nil), contentsDB(t, test.contents...))
+		assert.Equal(t, test.want, rec.Body.String(), test.contents)
+	}
+}
+
+func TestGetFreqWord(t *testing.T) {
+	db := contentsDB(t, "the cat\nand the dog", "the\tend  and")
+
+	rec := httptest.NewRecorder()
+	getFreqWord(rec, httptest.NewRequest(http.MethodGet, "/fw?limit=3", nil), db)
+	assert.Equal(t, "The 3 most frequent words are:\nthe 3\nand 2\ncat 1\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	getFreqWord(rec, httptest.NewRequest(http.MethodGet, "/fw?order=asc&offset=1&limit=9223372036854775807", nil), db)
+	assert.Equal(t, "The 4 least frequent words are:\ndog 1\nend 1\nand 2\nthe 3\n", rec.Body.String())
+
+	// The counts of all ranked words add up to the count of /wc
+	rec = httptest.NewRecorder()
+	getFreqWord(rec, httptest.NewRequest(http.MethodGet, "/fw?format=json&limit=100", nil), db)
+	var ranking []WordCount
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ranking))
+	total := 0
+	for _, wc := range ranking {
+		total += wc.Count
+	}
+	rec = httptest.NewRecorder()
+	getWordCount(rec, httptest.NewRequest(http.MethodGet, "/wc", nil), db)
+	assert.Equal(t, fmt.Sprintf("All files contain %d words \n", total), rec.Body.String())
+}
+
+func TestGetFreqWordInvalidParameters(t *testing.T) {
+	for _, query := range []string{"order=up", "limit=-1", "limit=x", "offset=-3", "format=xml"} {
+		req := httptest.NewRequest(http.MethodGet, "/fw?"+query, nil)
+		rec := httptest.NewRecorder()
+
+		getFreqWord(rec, req, nil)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	b := "one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\n"
+
+	var out strings.Builder
+	assert.NoError(t, unifiedDiff(&out, "a.txt", "b.txt", a, b, 1))
+
+	assert.Equal(t, `--- a.txt
++++ b.txt
+@@ -1,3 +1,3 @@
+ one
+-two
++2
+ three
+@@ -10 +10,2 @@
+ ten
++eleven
+`, out.String())
+}
+
+func TestUnifiedDiffMergesCloseHunks(t *testing.T) {
+	var out strings.Builder
+	assert.NoError(t, unifiedDiff(&out, "a", "b", "a\nb\nc\nd\n", "x\nb\nc\ny\n", 3))
+
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-a\n+x\n b\n c\n-d\n+y\n", out.String())
+}
+
+func TestUnifiedDiffEmptySides(t *testing.T) {
+	var out strings.Builder
+	assert.NoError(t, unifiedDiff(&out, "a", "b", "", "new\n", 3))
+	assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1 @@\n+new\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, unifiedDiff(&out, "a", "b", "same\n", "same\n", 3))
+	assert.Empty(t, out.String())
+}
+
+func TestWordDiff(t *testing.T) {
+	var out strings.Builder
+	assert.NoError(t, wordDiff(&out, "the quick brown fox", "the slow brown fox jumps"))
+
+	assert.Equal(t, "the [-quick-]{+slow+} brown fox{+ jumps+}", out.String())
+}
+
+func TestDiffTooLarge(t *testing.T) {
+	a := strings.Repeat("a\n", maxDiffEdits)
+	b := strings.Repeat("b\n", maxDiffEdits)
+
+	var out strings.Builder
+	assert.ErrorIs(t, unifiedDiff(&out, "a", "b", a, b, 3), errDiffTooLarge)
+	assert.ErrorIs(t, wordDiff(&out, a, b), errDiffTooLarge)
+	assert.Empty(t, out.String())
+
+	// Up to maxDiffEdits edits are diffed
+	assert.NoError(t, unifiedDiff(&out, "a", "b", a, a[:len(a)/2]+strings.Repeat("b\n", maxDiffEdits/4), 3))
+	assert.NotEmpty(t, out.String())
+}
+
+func TestGetDiffInvalidParameters(t *testing.T) {
+	for _, query := range []string{"", "a=x&mode=side", "a=x&context=-1", "a=x&rev_a=first"} {
+		req := httptest.NewRequest(http.MethodGet, "/diff?"+query, nil)
+		rec := httptest.NewRecorder()
+
+		getDiff(rec, req, nil)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestApplyUnifiedDiff(t *testing.T) {
+	content := "one\ntwo\nthree\nfour\n"
+	patch := "--- a.txt\n+++ a.txt\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n@@ -4,0 +5 @@\n+five\n"
+
+	patched, err := applyUnifiedDiff(content, patch)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "one\n2\nthree\nfour\nfive\n", patched)
+}
+
+func TestApplyUnifiedDiffRoundTrip(t *testing.T) {
+	a := "alpha\nbeta\ngamma\ndelta\nepsilon\n"
+	b := "alpha\nBETA\ngamma\ndelta\nepsilon\nzeta\n"
+
+	var patch strings.Builder
+	assert.NoError(t, unifiedDiff(&patch, "a", "b", a, b, 1))
+
+	patched, err := applyUnifiedDiff(a, patch.String())
+
+	assert.NoError(t, err)
+	assert.Equal(t, b, patched)
+}
+
+func TestApplyUnifiedDiffConflict(t *testing.T) {
+	_, err := applyUnifiedDiff("one\nTWO\nthree\n", "@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n")
+	assert.ErrorIs(t, err, errPatchConflict)
+
+	_, err = applyUnifiedDiff("one\n", "@@ -5,1 +5,1 @@\n-five\n+5\n")
+	assert.ErrorIs(t, err, errPatchConflict)
+}
+
+func TestApplyUnifiedDiffInvalid(t *testing.T) {
+	_, err := applyUnifiedDiff("one\n", "not a patch")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errPatchConflict)
+
+	_, err = applyUnifiedDiff("one\n", "@@ -1,2 +1,2 @@\n-one\n+1\n")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errPatchConflict)
+}
+
+func TestApplyRange(t *testing.T) {
+	patched, err := applyRange("hello world", 6, 5, "there")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello there", patched)
+
+	patched, err = applyRange("hello", 5, 0, "!")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello!", patched)
+
+	// Ranges outside of the content, including ones whose end overflows
+	for _, r := range []struct{ offset, length int }{
+		{3, 10},
+		{6, 0},
+		{1, math.MaxInt},
+		{math.MaxInt, 1},
+		{math.MaxInt, math.MaxInt},
+	} {
+		_, err = applyRange("hello", r.offset, r.length, "x")
+		assert.ErrorIs(t, err, errPatchConflict, "offset %d length %d", r.offset, r.length)
+	}
+}
+
+func TestPatchFileInvalidRequests(t *testing.T) {
+	tests := []struct {
+		method string
+		query  string
+		status int
+	}{
+		{http.MethodPost, "name=a.txt", http.StatusMethodNotAllowed},
+		{http.MethodPatch, "", http.StatusBadRequest},
+		{http.MethodPatch, "name=a.txt&op=truncate", http.StatusBadRequest},
+		{http.MethodPatch, "name=a.txt&op=range&offset=0&length=1", http.StatusBadRequest},
+		{http.MethodPatch, "name=a.txt&op=range&base=abc&offset=-1", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/patch?"+test.query, strings.NewReader("x"))
+		rec := httptest.NewRecorder()
+
+		patchFile(rec, req, nil)
+
+		assert.Equal(t, test.status, rec.Code, test.query)
+	}
+}
+
+func TestDownloadAndDeleteInvalidRequests(t *testing.T) {
+	rec := httptest.NewRecorder()
+	downloadFile(rec, httptest.NewRequest(http.MethodGet, "/download", nil), nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Neither a name nor uploaded files
+	rec = httptest.NewRecorder()
+	deleteFile(rec, httptest.NewRequest(http.MethodDelete, "/delete", nil), nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := t.TempDir() + "/server.yaml"
+	assert.NoError(t, os.WriteFile(path, []byte(`
+listen: ":8080"
+database:
+  user: file-user
+  name: files
+  port: 3307
+limits:
+  grep_timeout: 5s
+features:
+  patch: false
+`), 0600))
+	t.Setenv("STORE_SERVER_CONFIG", path)
+	t.Setenv("DB_USER", "env-user")
+	t.Setenv("DB_PASSWORD", "secret")
+	t.Setenv("STORE_LISTEN", ":9090")
+
+	cfg, printConfig, err := loadConfig([]string{"-listen", ":7070", "-max-upload-bytes", "1024"}, io.Discard)
+	assert.NoError(t, err)
+	assert.False(t, printConfig)
+	assert.Equal(t, ":7070", cfg.Listen)
+	assert.Equal(t, "env-user", cfg.Database.User)
+	assert.Equal(t, "files", cfg.Database.Name)
+	assert.Equal(t, 3307, cfg.Database.Port)
+	assert.Equal(t, "127.0.0.1", cfg.Database.Host)
+	assert.Equal(t, int64(1024), cfg.Limits.MaxUploadBytes)
+	assert.Equal(t, server.Duration(5*time.Second), cfg.Limits.GrepTimeout)
+	assert.False(t, cfg.Features.Patch)
+	assert.True(t, cfg.Features.Grep)
+
+	var out strings.Builder
+	assert.NoError(t, writeConfig(&out, cfg))
+	assert.Contains(t, out.String(), "password: REDACTED\n")
+	assert.Contains(t, out.String(), "grep_timeout: 5s\n")
+	assert.NotContains(t, out.String(), "secret")
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path := t.TempDir() + "/server.yaml"
+	assert.NoError(t, os.WriteFile(path, []byte("limits:\n  max_upload: 10\n"), 0600))
+	_, _, err := loadConfig([]string{"-config", path}, io.Discard)
+	assert.ErrorContains(t, err, "field max_upload not found")
+
+	t.Setenv("DB_PORT", "mysql")
+	_, _, err = loadConfig(nil, io.Discard)
+	assert.ErrorContains(t, err, `invalid DB_PORT "mysql"`)
+
+	t.Setenv("DB_PORT", "")
+	t.Setenv("DB_USER", "")
+	t.Setenv("DB_NAME", "")
+	_, _, err = loadConfig([]string{"-listen", "2021", "-grep-timeout", "2m"}, io.Discard)
+	assert.ErrorContains(t, err, "listen: invalid address")
+	assert.ErrorContains(t, err, "database.user is required")
+	assert.ErrorContains(t, err, "limits.grep_timeout 2m0s is longer than limits.max_grep_timeout 1m0s")
+
+	t.Setenv("STORE_TRACING_SAMPLE_RATIO", "2")
+	_, _, err = loadConfig([]string{"-tracing-endpoint", "localhost:4318"}, io.Discard)
+	assert.ErrorContains(t, err, `tracing.endpoint: "localhost:4318" is not an http or https URL`)
+	assert.ErrorContains(t, err, "tracing.sample_ratio: 2 is not between 0 and 1")
+	t.Setenv("STORE_TRACING_SAMPLE_RATIO", "")
+
+	// The settings are printed even when they are invalid
+	_, printConfig, err := loadConfig([]string{"-print-config"}, io.Discard)
+	assert.NoError(t, err)
+	assert.True(t, printConfig)
+}
+
+func TestUploadLimit(t *testing.T) {
+	defer func(limits server.LimitsConfig) { config.Limits = limits }(config.Limits)
+	config.Limits.MaxUploadBytes = 100
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("files", "big.txt")
+	part.Write(bytes.Repeat([]byte("a"), 200))
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/add", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	postFiles(rec, req, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = httptest.NewRecorder()
+	postFiles(rec, httptest.NewRequest(http.MethodPost, "/add", strings.NewReader("not a form")), nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	url := "http://" + listener.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newHTTPServer(server.DefaultConfig(), handler), listener, time.Second)
+	}()
+
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+
+	<-started
+	cancel()
+	// New connections are refused while the running request finishes
+	assert.Eventually(t, func() bool {
+		_, err := net.Dial("tcp", listener.Addr().String())
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+
+	assert.Equal(t, "done", <-response)
+	assert.NoError(t, <-served)
+}
+
+func TestServeAbortsAfterTimeout(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newHTTPServer(server.DefaultConfig(), handler), listener, 50*time.Millisecond)
+	}()
+
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+	cancel()
+	assert.ErrorContains(t, <-served, "requests still running after 50ms were aborted")
+}
+
+// testCA signs certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for name and its key to dir and returns the
+// paths of the two files
+func (ca *testCA) issue(t *testing.T, dir string, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, os.WriteFile(caFile, ca.pem, 0600))
+	certFile, keyFile := ca.issue(t, dir, "server", 2, x509.ExtKeyUsageServerAuth)
+
+	tlsConfig, err := newTLSConfig(server.TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		ClientAuth:   server.ClientAuthRequire,
+		ClientUsers:  map[string]string{"alice": "alice@example.com"},
+	})
+	assert.NoError(t, err)
+
+	handler := authenticateClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, requestUser(r))
+	}), map[string]string{"alice": "alice@example.com"})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serve(ctx, newHTTPServer(server.DefaultConfig(), handler), tls.NewListener(listener, tlsConfig), time.Second)
+
+	get := func(clientName string) (int, string, error) {
+		clientConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+		clientConfig.RootCAs.AddCert(ca.cert)
+		if clientName != "" {
+			cert, err := tls.LoadX509KeyPair(ca.issue(t, dir, clientName, 3, x509.ExtKeyUsageClientAuth))
+			assert.NoError(t, err)
+			clientConfig.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		resp, err := client.Get("https://" + listener.Addr().String())
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), nil
+	}
+
+	status, user, err := get("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "alice@example.com", user)
+
+	status, _, err = get("mallory")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	_, _, err = get("")
+	assert.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server", 2, x509.ExtKeyUsageServerAuth)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	cert, _ := reloader.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, int64(2), leaf.SerialNumber.Int64())
+
+	// A renewed certificate is served once the files change
+	ca.issue(t, dir, "server", 5, x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	cert, _ = reloader.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, int64(5), leaf.SerialNumber.Int64())
+
+	// A broken file keeps the previous certificate
+	os.WriteFile(certFile, []byte("broken"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	cert, err = reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, int64(5), leaf.SerialNumber.Int64())
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database.User, cfg.Database.Name = "store", "files"
+	cfg.TLS.CertFile = "server.crt"
+	cfg.TLS.ClientAuth = "always"
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "cert_file and key_file must be set together")
+	assert.ErrorContains(t, err, `"always" is not none, optional or require`)
+
+	cfg.TLS.KeyFile = "server.key"
+	cfg.TLS.ClientAuth = server.ClientAuthRequire
+	assert.ErrorContains(t, cfg.Validate(), "needs cert_file, key_file and client_ca_file")
+	cfg.TLS.ClientCAFile = "ca.crt"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestAccessLog(t *testing.T) {
+	var logs bytes.Buffer
+	logger, err := newLogger(server.LogConfig{Level: "info", Format: "json"}, &logs)
+	assert.NoError(t, err)
+	defer func(l *slog.Logger) { slog.SetDefault(l) }(slog.Default())
+	slog.SetDefault(logger)
+
+	var seen string
+	handler := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = server.RequestID(r.Context())
+		if r.URL.Path == "/fail" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "pong")
+		w.(http.Flusher).Flush()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	req.Header.Set(requestIDHeader, "build-42.step_1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "build-42.step_1", rec.Header().Get(requestIDHeader))
+	assert.Equal(t, "build-42.step_1", seen)
+	assert.True(t, rec.Flushed)
+
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &line))
+	assert.Equal(t, "INFO", line["level"])
+	assert.Equal(t, "request", line["msg"])
+	assert.Equal(t, "build-42.step_1", line["request_id"])
+	assert.Equal(t, float64(200), line["status"])
+	assert.Equal(t, float64(4), line["bytes_out"])
+
+	// IDs that could forge log lines are replaced
+	logs.Reset()
+	req = httptest.NewRequest(http.MethodGet, "/fail", nil)
+	req.Header.Set(requestIDHeader, "a\nb")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	id := rec.Header().Get(requestIDHeader)
+	assert.Regexp(t, "^[0-9a-f]{16}$", id)
+	assert.Equal(t, id, seen)
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &line))
+	assert.Equal(t, "ERROR", line["level"])
+	assert.Equal(t, float64(500), line["status"])
+}
+
+func TestLogConfigValidation(t *testing.T) {
+	_, err := newLogger(server.LogConfig{Level: "info", Format: "xml"}, io.Discard)
+	assert.ErrorContains(t, err, `unknown log format "xml"`)
+
+	cfg := server.DefaultConfig()
+	cfg.Database.User, cfg.Database.Name = "store", "files"
+	cfg.Log.Level = "verbose"
+	assert.ErrorContains(t, cfg.Validate(), "verbose")
+	cfg.Log.Level = "DEBUG"
+	assert.NoError(t, cfg.Validate())
+}
+
+// unconnectedDB returns a database handle for handlers that fail before
+// running queries. It does not connect until a query is run.
+func unconnectedDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		DSN:                       "store:secret@tcp(127.0.0.1:1)/files",
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{DisableAutomaticPing: true})
+	assert.NoError(t, err)
+	return db
+}
+
+func TestMetrics(t *testing.T) {
+	mux := newMux(unconnectedDB(t))
+	served := func(route string, status string) float64 {
+		return testutil.ToFloat64(httpRequests.WithLabelValues(route, http.MethodGet, status))
+	}
+	pings, missing := served("/ping", "200"), served("/download", "400")
+	sent := testutil.ToFloat64(httpSent.WithLabelValues("/ping"))
+
+	for _, target := range []string{"/ping", "/ping", "/download"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	assert.Equal(t, pings+2, served("/ping", "200"))
+	assert.Equal(t, missing+1, served("/download", "400"))
+	assert.Equal(t, sent+2*float64(len("pong working!")), testutil.ToFloat64(httpSent.WithLabelValues("/ping")))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `store_http_request_duration_seconds_count{method="GET",route="/ping",status="200"}`)
+	assert.Contains(t, rec.Body.String(), `store_http_received_bytes_total{route="/download"} 0`)
+
+	// Unknown methods share one label
+	assert.Equal(t, "OTHER", metricMethod("PROPFIND"))
+
+	defer func(features server.FeaturesConfig) { config.Features = features }(config.Features)
+	config.Features.Metrics = false
+	rec = httptest.NewRecorder()
+	newMux(unconnectedDB(t)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	getHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	failing := errors.New("table files is missing")
+	passed := healthCheck{"database", func(context.Context) error { return nil }}
+	failed := healthCheck{"migrations", func(context.Context) error { return failing }}
+
+	var response healthResponse
+	rec := httptest.NewRecorder()
+	getReadyz([]healthCheck{passed})(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, statusOK, response.Status)
+
+	rec = httptest.NewRecorder()
+	getReadyz([]healthCheck{passed, failed})(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, statusUnavailable, response.Status)
+	assert.Equal(t, []string{"database", "migrations"}, []string{response.Checks[0].Name, response.Checks[1].Name})
+	assert.Equal(t, statusOK, response.Checks[0].Status)
+	assert.Equal(t, statusFailed, response.Checks[1].Status)
+	assert.Equal(t, "table files is missing", response.Checks[1].Error)
+
+	// Without a database the server is alive but not ready
+	mux := newMux(unconnectedDB(t))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	for _, check := range response.Checks {
+		if check.Name == "temp_dir" {
+			assert.Equal(t, statusOK, check.Status)
+		} else {
+			assert.Equal(t, statusFailed, check.Status, check.Name)
+		}
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+// spanCollector is an in-process OTLP/HTTP collector that keeps the spans
+// it receives
+type spanCollector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *spanCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var request coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	response, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(response)
+}
+
+func (c *spanCollector) byName() map[string]*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := make(map[string]*tracepb.Span)
+	for _, span := range c.spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	collector := &spanCollector{}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	shutdown, err := setupTracing(server.TracingConfig{Endpoint: collectorServer.URL, SampleRatio: 1})
+	assert.NoError(t, err)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	db := unconnectedDB(t)
+	assert.NoError(t, db.Use(server.Tracing{}))
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("files", "a.txt")
+	part.Write([]byte("some content"))
+	writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/add", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	newMux(db).ServeHTTP(httptest.NewRecorder(), req)
+	assert.NoError(t, shutdown(context.Background()))
+
+	spans := collector.byName()
+	request := spans["POST /add"]
+	if assert.NotNil(t, request, "spans: %v", spans) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(request.TraceId))
+		assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(request.ParentSpanId))
+	}
+	for _, name := range []string{"parse multipart form", "hash content", "check duplicate"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, request.SpanId, spans[name].ParentSpanId, name)
+		}
+	}
+	query := spans["SELECT files"]
+	if assert.NotNil(t, query, "spans: %v", spans) {
+		assert.Equal(t, spans["check duplicate"].SpanId, query.ParentSpanId)
+		assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, query.Status.Code)
+		for _, attr := range query.Attributes {
+			if attr.Key == "db.query.text" {
+				assert.NotContains(t, attr.Value.GetStringValue(), "some content")
+			}
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limits := newThrottle(server.RateLimitConfig{
+		RequestsPerSecond: 10,
+		Burst:             2,
+		Routes:            map[string]server.RouteRateLimit{"/fw": {RequestsPerSecond: 0.5, Burst: 1}},
+	})
+	now := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	limits.now = func() time.Time { return now }
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	list, fw := limits.limit("/list", ok), limits.limit("/fw", ok)
+
+	get := func(handler http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	throttled := testutil.ToFloat64(throttledRequests.WithLabelValues("/fw", "rate"))
+
+	assert.Equal(t, http.StatusOK, get(list, "10.0.0.1:1000").Code)
+	assert.Equal(t, http.StatusOK, get(list, "10.0.0.1:1001").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get(list, "10.0.0.1:1002").Code)
+	// Other clients and routes have their own buckets
+	assert.Equal(t, http.StatusOK, get(list, "10.0.0.2:1000").Code)
+	assert.Equal(t, http.StatusOK, get(fw, "10.0.0.1:1003").Code)
+
+	rec := get(fw, "10.0.0.1:1004")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.Equal(t, throttled+1, testutil.ToFloat64(throttledRequests.WithLabelValues("/fw", "rate")))
+
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, http.StatusOK, get(fw, "10.0.0.1:1005").Code)
+
+	// Full buckets are dropped
+	now = now.Add(time.Hour)
+	get(list, "10.0.0.3:1000")
+	assert.Len(t, limits.limiters, 1)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	limits := newThrottle(server.RateLimitConfig{MaxConcurrent: map[string]int{"/wc": 1}})
+	started, release := make(chan struct{}), make(chan struct{})
+	wc := limits.limit("/wc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		wc.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/wc", nil))
+		close(done)
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	wc.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/wc", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	close(release)
+	<-done
+	go func() { <-started }()
+	rec = httptest.NewRecorder()
+	wc.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/wc", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestRateLimitValidation(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database.User, cfg.Database.Name = "store", "files"
+	cfg.RateLimit.Burst = 0
+	cfg.RateLimit.Routes["fw"] = server.RouteRateLimit{RequestsPerSecond: -1}
+	cfg.RateLimit.MaxConcurrent["/grep"] = 0
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "rate_limit.burst must be at least 1")
+	assert.ErrorContains(t, err, `rate_limit.routes: "fw" is not a route`)
+	assert.ErrorContains(t, err, "rate_limit.routes[fw].requests_per_second must not be negative")
+	assert.ErrorContains(t, err, "rate_limit.max_concurrent[/grep] must be positive")
+}
+
+func TestGetAuditInvalidParameters(t *testing.T) {
+	for _, query := range []string{"action=rename", "file_id=x", "file_id=0", "since=yesterday", "until=2024-05-02", "limit=0", "limit=1001", "offset=-1"} {
+		req := httptest.NewRequest(http.MethodGet, "/audit?"+query, nil)
+		rec := httptest.NewRecorder()
+
+		getAudit(rec, req, nil)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/audit?actor=ci&action=delete&file_id=3&since=2024-05-01T00:00:00Z&limit=10", nil)
+	filter, err := parseAuditFilter(req)
+	assert.NoError(t, err)
+	assert.Equal(t, server.AuditFilter{
+		Actor:  "ci",
+		Action: server.ActionDelete,
+		FileID: 3,
+		Since:  time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		Limit:  10,
+	}, filter)
+}
+
+func TestTrashInvalidRequests(t *testing.T) {
+	rec := httptest.NewRecorder()
+	trash(rec, httptest.NewRequest(http.MethodPost, "/trash", nil), nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, HEAD, DELETE", rec.Header().Get("Allow"))
+
+	rec = httptest.NewRecorder()
+	restoreFile(rec, httptest.NewRequest(http.MethodGet, "/trash/restore?name=a.txt", nil), nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = httptest.NewRecorder()
+	restoreFile(rec, httptest.NewRequest(http.MethodPost, "/trash/restore", nil), nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Missing 'name' parameter")
+}
+
+func TestTrashRetentionConfig(t *testing.T) {
+	assert.Equal(t, server.Duration(30*24*time.Hour), server.DefaultConfig().Trash.Retention)
+
+	t.Setenv("DB_USER", "store")
+	t.Setenv("DB_NAME", "files")
+	t.Setenv("STORE_TRASH_RETENTION", "72h")
+	cfg, _, err := loadConfig(nil, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, server.Duration(72*time.Hour), cfg.Trash.Retention)
+
+	cfg, _, err = loadConfig([]string{"-trash-retention", "0"}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, server.Duration(0), cfg.Trash.Retention)
+
+	_, _, err = loadConfig([]string{"-trash-retention", "-1h"}, io.Discard)
+	assert.ErrorContains(t, err, "trash.retention must not be negative")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "store_http_requests_total",
+		Help: "Requests served, by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "store_http_request_duration_seconds",
+		Help:    "Time taken to serve requests, by route, method and status.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method", "status"})
+	httpReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "store_http_received_bytes_total",
+		Help: "Bytes of request bodies read, such as uploads, by route.",
+	}, []string{"route"})
+	httpSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "store_http_sent_bytes_total",
+		Help: "Bytes of response bodies written, such as downloads, by route.",
+	}, []string{"route"})
+)
+
+// metricMethod returns the method label of a request. Other methods than
+// the standard ones are counted together, so that clients cannot create
+// any number of series.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// instrument records the requests served by next under route, which is the
+// pattern next is registered with rather than the path, to keep the number
+// of series bounded
+func instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method, status := metricMethod(r.Method), strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(route, method, status).Inc()
+		httpDuration.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+		httpReceived.WithLabelValues(route).Add(float64(body.n))
+		httpSent.WithLabelValues(route).Add(float64(rec.bytes))
+	})
+}
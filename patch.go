@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"file_storage_server/server"
+	"gorm.io/gorm"
+)
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// errPatchConflict is returned when a patch does not match the content it
+// is applied to
+var errPatchConflict = errors.New("patch does not apply")
+
+type hunk struct {
+	OldStart, OldCount int
+	NewStart, NewCount int
+	Lines              []string
+}
+
+// parseUnifiedDiff returns the hunks of a unified diff. File headers and
+// any text before the first hunk are ignored.
+func parseUnifiedDiff(patch string) ([]hunk, error) {
+	var hunks []hunk
+	lines := splitLines(patch)
+
+	for i := 0; i < len(lines); {
+		match := hunkHeaderPattern.FindStringSubmatch(lines[i])
+		if match == nil {
+			if len(hunks) > 0 {
+				return nil, fmt.Errorf("unexpected line %d: %q", i+1, lines[i])
+			}
+			i++
+			continue
+		}
+
+		h := hunk{
+			OldStart: atoiDefault(match[1], 0),
+			OldCount: atoiDefault(match[2], 1),
+			NewStart: atoiDefault(match[3], 0),
+			NewCount: atoiDefault(match[4], 1),
+		}
+		i++
+
+		oldSeen, newSeen := 0, 0
+		for i < len(lines) && (oldSeen < h.OldCount || newSeen < h.NewCount) {
+			line := lines[i]
+			i++
+			if strings.HasPrefix(line, "\\") {
+				// "\ No newline at end of file"
+				continue
+			}
+			if line == "" {
+				// Some editors strip the space from empty context lines
+				line = " "
+			}
+			switch line[0] {
+			case ' ':
+				oldSeen++
+				newSeen++
+			case '-':
+				oldSeen++
+			case '+':
+				newSeen++
+			default:
+				return nil, fmt.Errorf("invalid line %d in hunk: %q", i, line)
+			}
+			h.Lines = append(h.Lines, line)
+		}
+		if oldSeen != h.OldCount || newSeen != h.NewCount {
+			return nil, fmt.Errorf("hunk at line %d does not match its header", i)
+		}
+		for i < len(lines) && strings.HasPrefix(lines[i], "\\") {
+			i++
+		}
+
+		hunks = append(hunks, h)
+	}
+
+	if len(hunks) == 0 {
+		return nil, errors.New("patch contains no hunks")
+	}
+	return hunks, nil
+}
+
+func atoiDefault(s string, fallback int) int {
+	if s == "" {
+		return fallback
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// applyUnifiedDiff applies a unified diff to content. Every context and
+// removed line must match exactly, otherwise errPatchConflict is returned.
+func applyUnifiedDiff(content string, patch string) (string, error) {
+	hunks, err := parseUnifiedDiff(patch)
+	if err != nil {
+		return "", err
+	}
+
+	old := splitLines(content)
+	var result []string
+	cursor := 0
+
+	for _, h := range hunks {
+		// An empty old range names the line it follows
+		pos := h.OldStart - 1
+		if h.OldCount == 0 {
+			pos = h.OldStart
+		}
+		if pos < cursor || pos > len(old) {
+			return "", fmt.Errorf("%w: hunk @@ -%d,%d @@ is out of range", errPatchConflict, h.OldStart, h.OldCount)
+		}
+
+		result = append(result, old[cursor:pos]...)
+		for _, line := range h.Lines {
+			switch line[0] {
+			case ' ', '-':
+				if pos >= len(old) || old[pos] != line[1:] {
+					return "", fmt.Errorf("%w: line %d does not match", errPatchConflict, pos+1)
+				}
+				if line[0] == ' ' {
+					result = append(result, old[pos])
+				}
+				pos++
+			case '+':
+				result = append(result, line[1:])
+			}
+		}
+		cursor = pos
+	}
+	result = append(result, old[cursor:]...)
+
+	if len(result) == 0 {
+		return "", nil
+	}
+	patched := strings.Join(result, "\n")
+	if content == "" || strings.HasSuffix(content, "\n") {
+		patched += "\n"
+	}
+	return patched, nil
+}
+
+// applyRange replaces length bytes of content starting at offset with data.
+// The length is compared with what follows the offset, since offset+length
+// may overflow.
+func applyRange(content string, offset int, length int, data string) (string, error) {
+	if offset > len(content) || length > len(content)-offset {
+		return "", fmt.Errorf("%w: range %d+%d is outside of the %d byte file", errPatchConflict, offset, length, len(content))
+	}
+	return content[:offset] + data + content[offset+length:], nil
+}
+
+// Apply a partial update to a stored file.
+//
+// Query parameters:
+//   name    file to update
+//   op      diff (default) to apply the unified diff in the body, append to
+//           add the body to the end of the file, or range to replace
+//           length bytes at offset with the body
+//   offset, length  byte range for op=range
+//   base    expected hash of the current content, may also be sent in the
+//           If-Match header. Required for op=range.
+func patchFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.Method != http.MethodPatch {
+		w.Header().Set("Allow", http.MethodPatch)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+
+	op := query.Get("op")
+	if op == "" {
+		op = "diff"
+	}
+	if op != "diff" && op != "append" && op != "range" {
+		http.Error(w, "Invalid 'op' parameter. Use 'diff', 'append' or 'range'.", http.StatusBadRequest)
+		return
+	}
+
+	base := query.Get("base")
+	if base == "" {
+		base = strings.Trim(r.Header.Get("If-Match"), `"`)
+	}
+	if op == "range" && base == "" {
+		http.Error(w, "Missing 'base' parameter, required for range updates", http.StatusBadRequest)
+		return
+	}
+
+	var offset, length int
+	var err error
+	if op == "range" {
+		if offset, err = parseNonNegativeInt(r, "offset", 0); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if length, err = parseNonNegativeInt(r, "length", 0); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.Limits.MaxPatchBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	existingFile, err := server.GetFileByName(db, name)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+
+	if base != "" && base != existingFile.HashDigest {
+		http.Error(w, fmt.Sprintf("Base hash %s does not match the current content of %s", base, name), http.StatusConflict)
+		return
+	}
+
+	var patched string
+	switch op {
+	case "diff":
+		patched, err = applyUnifiedDiff(existingFile.Content, string(body))
+	case "append":
+		patched = existingFile.Content + string(body)
+	case "range":
+		patched, err = applyRange(existingFile.Content, offset, length, string(body))
+	}
+	if errors.Is(err, errPatchConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid patch: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	hashString := hashContent(r.Context(), []byte(patched))
+
+	// The patch was applied to the content read above, it is only saved if
+	// no other request changed the file in the meantime
+	readHash := existingFile.HashDigest
+	existingFile.Content = patched
+	existingFile.HashDigest = hashString
+	existingFile.UpdatedAt = time.Now()
+
+	if err := server.UpdateFileIfUnchanged(db, existingFile, readHash); err != nil {
+		switch {
+		case errors.Is(err, server.ErrContentChanged):
+			http.Error(w, fmt.Sprintf("%s was changed by another request while it was patched, retry", name), http.StatusConflict)
+		case errors.Is(err, server.ErrFileNotFound):
+			writeLookupError(w, err)
+		default:
+			http.Error(w, fmt.Sprintf("Some error occured while updating, %s", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("ETag", `"`+hashString+`"`)
+	fmt.Fprintf(w, "File patched successfully, new hash %s\n", hashString)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"file_storage_server/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var throttledRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "store_throttled_requests_total",
+	Help: "Requests refused with 429, by route and reason: rate when the client sent too many, concurrency when the route was busy.",
+}, []string{"route", "reason"})
+
+// limiterSweepInterval is how often limiters of clients that stopped
+// sending requests are dropped
+const limiterSweepInterval = time.Minute
+
+// busyRetryAfter is the wait suggested to clients refused because a route
+// serves as many requests as it may
+const busyRetryAfter = time.Second
+
+// throttle applies the rate and concurrency limits of the configuration
+type throttle struct {
+	cfg server.RateLimitConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	limiters  map[limiterKey]*rate.Limiter
+	lastSweep time.Time
+}
+
+type limiterKey struct {
+	route  string
+	client string
+}
+
+func newThrottle(cfg server.RateLimitConfig) *throttle {
+	return &throttle{
+		cfg:      cfg,
+		now:      time.Now,
+		limiters: make(map[limiterKey]*rate.Limiter),
+	}
+}
+
+// limit refuses the requests to route that go over the rate of their
+// client or over the number of requests the route may serve at once. They
+// are answered with 429 and a Retry-After header.
+func (t *throttle) limit(route string, next http.Handler) http.Handler {
+	limit := t.cfg.Route(route)
+	var slots chan struct{}
+	if n := t.cfg.MaxConcurrent[route]; n > 0 {
+		slots = make(chan struct{}, n)
+	}
+	if limit.RequestsPerSecond <= 0 && slots == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit.RequestsPerSecond > 0 {
+			if wait := t.reserve(limiterKey{route, clientKey(r)}, limit); wait > 0 {
+				tooManyRequests(w, route, "rate", wait)
+				return
+			}
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				tooManyRequests(w, route, "concurrency", busyRetryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reserve takes a token from the bucket of key. When the bucket is empty it
+// returns how long the client has to wait for the next token.
+func (t *throttle) reserve(key limiterKey, limit server.RouteRateLimit) time.Duration {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastSweep) >= limiterSweepInterval {
+		t.sweep(now)
+	}
+
+	limiter, ok := t.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), limit.Burst)
+		t.limiters[key] = limiter
+	}
+	reservation := limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// sweep drops the limiters whose bucket is full again, since they behave
+// like new ones
+func (t *throttle) sweep(now time.Time) {
+	for key, limiter := range t.limiters {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(t.limiters, key)
+		}
+	}
+	t.lastSweep = now
+}
+
+// clientKey identifies the client of a request for rate limiting: the user
+// of its client certificate, or else its IP address. Bearer tokens are not
+// used, since the server does not check them and a client could change its
+// token to get a new bucket.
+func clientKey(r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		return "user:" + user
+	}
+	return "ip:" + remoteIP(r)
+}
+
+func tooManyRequests(w http.ResponseWriter, route string, reason string, wait time.Duration) {
+	throttledRequests.WithLabelValues(route, reason).Inc()
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many requests, retry in %d seconds", seconds), http.StatusTooManyRequests)
+}
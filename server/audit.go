@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Audit actions
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	// ActionRestore takes a file out of the trash, ActionPurge removes it
+	// for good
+	ActionRestore = "restore"
+	ActionPurge   = "purge"
+)
+
+// AnonymousActor is the actor of changes made without a client certificate
+const AnonymousActor = "anonymous"
+
+// SystemActor is the actor of changes the server makes on its own, like
+// purging the trash
+const SystemActor = "system"
+
+// ErrAuditAppendOnly is returned when code tries to change or remove audit
+// entries through their model
+var ErrAuditAppendOnly = errors.New("audit entries can not be changed or deleted")
+
+func (AuditEntry) BeforeUpdate(*gorm.DB) error {
+	return ErrAuditAppendOnly
+}
+
+func (AuditEntry) BeforeDelete(*gorm.DB) error {
+	return ErrAuditAppendOnly
+}
+
+// Client is who sent a request, as recorded in the audit log
+type Client struct {
+	// User is the user of the client certificate, empty without one
+	User string
+	IP   string
+}
+
+// ContextWithClient returns a context carrying the client of the request.
+// Changes made with db.WithContext(ctx) are audited as made by it.
+func ContextWithClient(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, clientKey, client)
+}
+
+// addAuditEntry records a change to file within the transaction making it,
+// so that either both are stored or neither is
+func addAuditEntry(tx *gorm.DB, action string, file *File, oldHash string, newHash string) error {
+	ctx := tx.Statement.Context
+	client, _ := ctx.Value(clientKey).(Client)
+	actor := client.User
+	if actor == "" {
+		actor = AnonymousActor
+	}
+	return tx.Create(&AuditEntry{
+		CreatedAt: time.Now(),
+		Actor:     actor,
+		Action:    action,
+		FileID:    file.ID,
+		FileName:  file.Name,
+		OldHash:   oldHash,
+		NewHash:   newHash,
+		ClientIP:  client.IP,
+		RequestID: RequestID(ctx),
+	}).Error
+}
+
+// AuditFilter selects audit entries. Empty fields match every entry.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	FileID int
+	Name   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+}
+
+// GetAuditEntries returns the entries matching filter, newest first
+func GetAuditEntries(db *gorm.DB, filter AuditFilter) ([]AuditEntry, error) {
+	query := db.Model(&AuditEntry{})
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.FileID != 0 {
+		query = query.Where("file_id = ?", filter.FileID)
+	}
+	if filter.Name != "" {
+		query = query.Where("file_name = ?", filter.Name)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var entries []AuditEntry
+	err := query.Order("id DESC").Offset(filter.Offset).Find(&entries).Error
+	return entries, err
+}
@@ -0,0 +1,492 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the server. It is read from a YAML file,
+// then environment variables, then command line flags, each overriding the
+// one before, on top of DefaultConfig.
+type Config struct {
+	// Listen is the address the HTTP server listens on, e.g. ":2021"
+	Listen    string          `yaml:"listen"`
+	Timeouts  TimeoutsConfig  `yaml:"timeouts"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Log       LogConfig       `yaml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Trash     TrashConfig     `yaml:"trash"`
+	Features  FeaturesConfig  `yaml:"features"`
+}
+
+// TimeoutsConfig limits how long connections may take. Read and write
+// timeouts cover whole requests and responses, so they must leave time for
+// the largest uploads and downloads.
+type TimeoutsConfig struct {
+	ReadHeader Duration `yaml:"read_header"`
+	Read       Duration `yaml:"read"`
+	Write      Duration `yaml:"write"`
+	Idle       Duration `yaml:"idle"`
+	// Shutdown is how long running requests may take to finish when the
+	// server is stopped, before their connections are closed
+	Shutdown Duration `yaml:"shutdown"`
+}
+
+// TLSConfig turns on HTTPS when a certificate and key are set. The files
+// are read again when they change, so certificates can be renewed without a
+// restart.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile holds the CAs that sign client certificates
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is none, optional or require. Optional accepts clients
+	// without a certificate, but certificates that are sent must be valid.
+	ClientAuth string `yaml:"client_auth"`
+	// ClientUsers maps the common names of client certificates to users.
+	// When it is empty the common name is the user, otherwise certificates
+	// of other names are refused.
+	ClientUsers map[string]string `yaml:"client_users"`
+}
+
+// Client authentication modes of TLSConfig
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// Enabled reports whether the server speaks HTTPS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error. Database queries are logged at
+	// debug level.
+	Level string `yaml:"level"`
+	// Format is text or json
+	Format string `yaml:"format"`
+}
+
+// TracingConfig sends traces of the requests to an OpenTelemetry collector
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP URL of the collector, e.g.
+	// http://localhost:4318. Tracing is off when it is empty.
+	Endpoint string `yaml:"endpoint"`
+	// SampleRatio is the part of the requests traced, from 0 to 1. Requests
+	// that come with a sampled trace context are always traced.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// SlogLevel returns the slog level named by Level
+func (l LogConfig) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(l.Level))
+	return level, err
+}
+
+type DatabaseConfig struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Name     string `yaml:"name"`
+	// Connection pool settings, 0 keeps the database/sql defaults
+	MaxOpenConns    int      `yaml:"max_open_conns"`
+	MaxIdleConns    int      `yaml:"max_idle_conns"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime"`
+}
+
+type LimitsConfig struct {
+	// MaxUploadBytes is the largest request body accepted by add, update
+	// and delete
+	MaxUploadBytes int64 `yaml:"max_upload_bytes"`
+	// MultipartMemoryBytes is how much of an upload is kept in memory, the
+	// rest is written to temporary files while the request is parsed
+	MultipartMemoryBytes int64 `yaml:"multipart_memory_bytes"`
+	// MaxPatchBytes is the largest diff or data accepted by patch
+	MaxPatchBytes  int64    `yaml:"max_patch_bytes"`
+	GrepTimeout    Duration `yaml:"grep_timeout"`
+	MaxGrepTimeout Duration `yaml:"max_grep_timeout"`
+}
+
+// RateLimitConfig throttles the API routes. Each client, that is the user
+// of its client certificate or else its IP address, gets a token bucket
+// per route. Health checks and metrics are not limited.
+type RateLimitConfig struct {
+	// RequestsPerSecond is the rate a client may sustain on each route
+	// that is not in Routes, 0 for no limit
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is how many requests a client may send at once
+	Burst int `yaml:"burst"`
+	// Routes sets the rate and burst of some routes, e.g. "/fw"
+	Routes map[string]RouteRateLimit `yaml:"routes"`
+	// MaxConcurrent limits how many requests of a route are served at the
+	// same time, for all clients together
+	MaxConcurrent map[string]int `yaml:"max_concurrent"`
+}
+
+type RouteRateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+// Route returns the rate and burst of route
+func (c RateLimitConfig) Route(route string) RouteRateLimit {
+	if limit, ok := c.Routes[route]; ok {
+		return limit
+	}
+	return RouteRateLimit{RequestsPerSecond: c.RequestsPerSecond, Burst: c.Burst}
+}
+
+// TrashConfig sets how long deleted files are kept before they are purged
+type TrashConfig struct {
+	// Retention is how long a file stays in the trash, 0 to keep files
+	// until the trash is emptied
+	Retention Duration `yaml:"retention"`
+}
+
+// FeaturesConfig turns endpoints on and off. Disabled endpoints answer 404.
+type FeaturesConfig struct {
+	Grep    bool `yaml:"grep"`
+	Diff    bool `yaml:"diff"`
+	Patch   bool `yaml:"patch"`
+	Metrics bool `yaml:"metrics"`
+}
+
+// Duration is a time.Duration written as "10s" in configuration files
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, node.Value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	return Config{
+		Listen: ":2021",
+		Timeouts: TimeoutsConfig{
+			ReadHeader: Duration(10 * time.Second),
+			Read:       Duration(5 * time.Minute),
+			Write:      Duration(5 * time.Minute),
+			Idle:       Duration(2 * time.Minute),
+			Shutdown:   Duration(30 * time.Second),
+		},
+		TLS: TLSConfig{
+			ClientAuth: ClientAuthNone,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 1,
+		},
+		Database: DatabaseConfig{
+			Host: "127.0.0.1",
+			Port: 3306,
+		},
+		Limits: LimitsConfig{
+			MaxUploadBytes:       100 << 20,
+			MultipartMemoryBytes: 10 << 20,
+			MaxPatchBytes:        10 << 20,
+			GrepTimeout:          Duration(10 * time.Second),
+			MaxGrepTimeout:       Duration(60 * time.Second),
+		},
+		// Routes that read every stored file are limited more
+		RateLimit: RateLimitConfig{
+			RequestsPerSecond: 20,
+			Burst:             40,
+			Routes: map[string]RouteRateLimit{
+				"/wc":    {RequestsPerSecond: 1, Burst: 5},
+				"/fw":    {RequestsPerSecond: 1, Burst: 5},
+				"/stats": {RequestsPerSecond: 1, Burst: 5},
+				"/grep":  {RequestsPerSecond: 1, Burst: 5},
+			},
+			MaxConcurrent: map[string]int{
+				"/wc":    4,
+				"/fw":    4,
+				"/stats": 4,
+				"/grep":  4,
+			},
+		},
+		Trash: TrashConfig{
+			Retention: Duration(30 * 24 * time.Hour),
+		},
+		Features: FeaturesConfig{
+			Grep:    true,
+			Diff:    true,
+			Patch:   true,
+			Metrics: true,
+		},
+	}
+}
+
+// LoadFile reads the YAML file at path over the current settings. Unknown
+// keys are errors, so that typos do not go unnoticed.
+func (cfg *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading config file: %v", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv overrides the settings with the environment variables that are
+// set. The database variables keep the names used by the .env file.
+func (cfg *Config) ApplyEnv(getenv func(string) string) error {
+	var errs []error
+	str := func(target *string, name string) {
+		if value := getenv(name); value != "" {
+			*target = value
+		}
+	}
+	integer := func(target *int, name string) {
+		if value := getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q", name, value))
+				return
+			}
+			*target = n
+		}
+	}
+	size := func(target *int64, name string) {
+		if value := getenv(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q", name, value))
+				return
+			}
+			*target = n
+		}
+	}
+	duration := func(target *Duration, name string) {
+		if value := getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q", name, value))
+				return
+			}
+			*target = Duration(d)
+		}
+	}
+	decimal := func(target *float64, name string) {
+		if value := getenv(name); value != "" {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q", name, value))
+				return
+			}
+			*target = f
+		}
+	}
+	boolean := func(target *bool, name string) {
+		if value := getenv(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q", name, value))
+				return
+			}
+			*target = b
+		}
+	}
+
+	str(&cfg.Listen, "STORE_LISTEN")
+	duration(&cfg.Timeouts.ReadHeader, "STORE_READ_HEADER_TIMEOUT")
+	duration(&cfg.Timeouts.Read, "STORE_READ_TIMEOUT")
+	duration(&cfg.Timeouts.Write, "STORE_WRITE_TIMEOUT")
+	duration(&cfg.Timeouts.Idle, "STORE_IDLE_TIMEOUT")
+	duration(&cfg.Timeouts.Shutdown, "STORE_SHUTDOWN_TIMEOUT")
+	str(&cfg.Log.Level, "STORE_LOG_LEVEL")
+	str(&cfg.Log.Format, "STORE_LOG_FORMAT")
+	str(&cfg.Tracing.Endpoint, "STORE_TRACING_ENDPOINT")
+	decimal(&cfg.Tracing.SampleRatio, "STORE_TRACING_SAMPLE_RATIO")
+	str(&cfg.TLS.CertFile, "STORE_TLS_CERT_FILE")
+	str(&cfg.TLS.KeyFile, "STORE_TLS_KEY_FILE")
+	str(&cfg.TLS.ClientCAFile, "STORE_TLS_CLIENT_CA_FILE")
+	str(&cfg.TLS.ClientAuth, "STORE_TLS_CLIENT_AUTH")
+	str(&cfg.Database.User, "DB_USER")
+	str(&cfg.Database.Password, "DB_PASSWORD")
+	str(&cfg.Database.Host, "DB_HOST")
+	integer(&cfg.Database.Port, "DB_PORT")
+	str(&cfg.Database.Name, "DB_NAME")
+	integer(&cfg.Database.MaxOpenConns, "DB_MAX_OPEN_CONNS")
+	integer(&cfg.Database.MaxIdleConns, "DB_MAX_IDLE_CONNS")
+	duration(&cfg.Database.ConnMaxLifetime, "DB_CONN_MAX_LIFETIME")
+	size(&cfg.Limits.MaxUploadBytes, "STORE_MAX_UPLOAD_BYTES")
+	size(&cfg.Limits.MultipartMemoryBytes, "STORE_MULTIPART_MEMORY_BYTES")
+	size(&cfg.Limits.MaxPatchBytes, "STORE_MAX_PATCH_BYTES")
+	duration(&cfg.Limits.GrepTimeout, "STORE_GREP_TIMEOUT")
+	duration(&cfg.Limits.MaxGrepTimeout, "STORE_MAX_GREP_TIMEOUT")
+	decimal(&cfg.RateLimit.RequestsPerSecond, "STORE_RATE_LIMIT")
+	integer(&cfg.RateLimit.Burst, "STORE_RATE_LIMIT_BURST")
+	duration(&cfg.Trash.Retention, "STORE_TRASH_RETENTION")
+	boolean(&cfg.Features.Grep, "STORE_ENABLE_GREP")
+	boolean(&cfg.Features.Diff, "STORE_ENABLE_DIFF")
+	boolean(&cfg.Features.Patch, "STORE_ENABLE_PATCH")
+	boolean(&cfg.Features.Metrics, "STORE_ENABLE_METRICS")
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the settings before the server starts and reports every
+// problem at once
+func (cfg *Config) Validate() error {
+	var errs []error
+	checkRoute := func(route string, setting string) {
+		if !strings.HasPrefix(route, "/") {
+			errs = append(errs, fmt.Errorf("%s: %q is not a route, e.g. /fw", setting, route))
+		}
+	}
+	if _, port, err := net.SplitHostPort(cfg.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: invalid address %q: %v", cfg.Listen, err))
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		errs = append(errs, fmt.Errorf("listen: invalid port %q", port))
+	}
+
+	// 0 disables the read, write and idle timeouts like in http.Server, but
+	// the server must not wait forever for headers or for a shutdown
+	if cfg.Timeouts.ReadHeader <= 0 || cfg.Timeouts.Shutdown <= 0 {
+		errs = append(errs, errors.New("timeouts: read_header and shutdown must be positive"))
+	}
+	if cfg.Timeouts.Read < 0 || cfg.Timeouts.Write < 0 || cfg.Timeouts.Idle < 0 {
+		errs = append(errs, errors.New("timeouts must not be negative"))
+	}
+	if cfg.Timeouts.Write > 0 && cfg.Timeouts.Write < cfg.Limits.MaxGrepTimeout {
+		errs = append(errs, fmt.Errorf("timeouts.write %s is shorter than limits.max_grep_timeout %s",
+			cfg.Timeouts.Write, cfg.Limits.MaxGrepTimeout))
+	}
+
+	if cfg.TLS.Enabled() && (cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file must be set together"))
+	}
+	switch cfg.TLS.ClientAuth {
+	case ClientAuthNone:
+		if len(cfg.TLS.ClientUsers) > 0 {
+			errs = append(errs, errors.New("tls.client_users needs tls.client_auth optional or require"))
+		}
+	case ClientAuthOptional, ClientAuthRequire:
+		if !cfg.TLS.Enabled() || cfg.TLS.ClientCAFile == "" {
+			errs = append(errs, fmt.Errorf("tls.client_auth %s needs cert_file, key_file and client_ca_file", cfg.TLS.ClientAuth))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tls.client_auth: %q is not none, optional or require", cfg.TLS.ClientAuth))
+	}
+
+	if _, err := cfg.Log.SlogLevel(); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %q is not debug, info, warn or error", cfg.Log.Level))
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format: %q is not text or json", cfg.Log.Format))
+	}
+
+	if cfg.Tracing.Endpoint != "" {
+		if u, err := url.Parse(cfg.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint: %q is not an http or https URL", cfg.Tracing.Endpoint))
+		}
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio: %v is not between 0 and 1", cfg.Tracing.SampleRatio))
+	}
+
+	if cfg.Database.User == "" {
+		errs = append(errs, errors.New("database.user is required"))
+	}
+	if cfg.Database.Host == "" {
+		errs = append(errs, errors.New("database.host is required"))
+	}
+	if cfg.Database.Name == "" {
+		errs = append(errs, errors.New("database.name is required"))
+	}
+	if cfg.Database.Port < 1 || cfg.Database.Port > 65535 {
+		errs = append(errs, fmt.Errorf("database.port: %d is not a valid port", cfg.Database.Port))
+	}
+	if cfg.Database.MaxOpenConns < 0 || cfg.Database.MaxIdleConns < 0 || cfg.Database.ConnMaxLifetime < 0 {
+		errs = append(errs, errors.New("database: pool settings must not be negative"))
+	}
+
+	if cfg.Limits.MaxUploadBytes <= 0 {
+		errs = append(errs, errors.New("limits.max_upload_bytes must be positive"))
+	}
+	if cfg.Limits.MultipartMemoryBytes <= 0 {
+		errs = append(errs, errors.New("limits.multipart_memory_bytes must be positive"))
+	}
+	if cfg.Limits.MaxPatchBytes <= 0 {
+		errs = append(errs, errors.New("limits.max_patch_bytes must be positive"))
+	}
+	if cfg.Limits.GrepTimeout <= 0 || cfg.Limits.MaxGrepTimeout <= 0 {
+		errs = append(errs, errors.New("limits: grep timeouts must be positive"))
+	} else if cfg.Limits.GrepTimeout > cfg.Limits.MaxGrepTimeout {
+		errs = append(errs, fmt.Errorf("limits.grep_timeout %s is longer than limits.max_grep_timeout %s",
+			cfg.Limits.GrepTimeout, cfg.Limits.MaxGrepTimeout))
+	}
+
+	checkRate := func(name string, limit RouteRateLimit) {
+		if limit.RequestsPerSecond < 0 {
+			errs = append(errs, fmt.Errorf("%s.requests_per_second must not be negative", name))
+		} else if limit.RequestsPerSecond > 0 && limit.Burst < 1 {
+			errs = append(errs, fmt.Errorf("%s.burst must be at least 1", name))
+		}
+	}
+	checkRate("rate_limit", RouteRateLimit{cfg.RateLimit.RequestsPerSecond, cfg.RateLimit.Burst})
+	for _, route := range slices.Sorted(maps.Keys(cfg.RateLimit.Routes)) {
+		checkRoute(route, "rate_limit.routes")
+		checkRate(fmt.Sprintf("rate_limit.routes[%s]", route), cfg.RateLimit.Routes[route])
+	}
+	for _, route := range slices.Sorted(maps.Keys(cfg.RateLimit.MaxConcurrent)) {
+		checkRoute(route, "rate_limit.max_concurrent")
+		if cfg.RateLimit.MaxConcurrent[route] < 1 {
+			errs = append(errs, fmt.Errorf("rate_limit.max_concurrent[%s] must be positive", route))
+		}
+	}
+
+	if cfg.Trash.Retention < 0 {
+		errs = append(errs, errors.New("trash.retention must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the settings that is safe to print
+func (cfg Config) Redacted() Config {
+	if cfg.Database.Password != "" {
+		cfg.Database.Password = "REDACTED"
+	}
+	return cfg
+}
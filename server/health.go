@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// PingDatabase checks that the database accepts connections
+func PingDatabase(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// CheckMigrations checks that the tables and columns of the models exist,
+// that is that Migrate has been run by this version of the server
+func CheckMigrations(ctx context.Context, db *gorm.DB) error {
+	db = db.WithContext(ctx)
+	migrator := db.Migrator()
+	var errs []error
+	for _, model := range models() {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		if !migrator.HasTable(model) {
+			errs = append(errs, fmt.Errorf("table %s is missing", table))
+			continue
+		}
+
+		columnTypes, err := migrator.ColumnTypes(model)
+		if err != nil {
+			return err
+		}
+		columns := make(map[string]bool, len(columnTypes))
+		for _, columnType := range columnTypes {
+			columns[columnType.Name()] = true
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !columns[field.DBName] {
+				errs = append(errs, fmt.Errorf("column %s.%s is missing", table, field.DBName))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CheckWritable checks that the database, which stores the contents of the
+// files, accepts writes. Replicas and servers being maintained are usually
+// read-only.
+func CheckWritable(ctx context.Context, db *gorm.DB) error {
+	var readOnly bool
+	if err := db.WithContext(ctx).Raw("SELECT @@read_only").Scan(&readOnly).Error; err != nil {
+		return err
+	}
+	if readOnly {
+		return errors.New("database is read-only")
+	}
+	return nil
+}
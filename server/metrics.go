@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+var (
+	queryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "store_db_query_duration_seconds",
+		Help:    "Duration of database queries.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	})
+	dedupChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "store_dedup_checks_total",
+		Help: "Uploads checked for content that is already stored, by result: hit when it is, miss when it is not.",
+	}, []string{"result"})
+)
+
+// storageScrapeTimeout limits the queries run when metrics are collected
+const storageScrapeTimeout = 5 * time.Second
+
+// RegisterMetrics adds the connection pool statistics of db, labeled with
+// the database name, and the number and size of stored files to the
+// default Prometheus registry
+func RegisterMetrics(db *gorm.DB, name string) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := prometheus.Register(collectors.NewDBStatsCollector(sqlDB, name)); err != nil {
+		return err
+	}
+	return prometheus.Register(&storageCollector{db: db})
+}
+
+// storageCollector reads the number and size of stored files from the
+// database when metrics are scraped
+type storageCollector struct {
+	db *gorm.DB
+}
+
+var (
+	filesDesc = prometheus.NewDesc("store_files",
+		"Number of stored files, without the ones in the trash.", nil, nil)
+	trashFilesDesc = prometheus.NewDesc("store_trash_files",
+		"Number of files in the trash.", nil, nil)
+	storedBytesDesc = prometheus.NewDesc("store_stored_bytes",
+		"Size of the stored contents, by table: files for current contents, trashed files included, file_revisions for all revisions.", []string{"table"}, nil)
+)
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- filesDesc
+	ch <- trashFilesDesc
+	ch <- storedBytesDesc
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageScrapeTimeout)
+	defer cancel()
+	db := c.db.WithContext(ctx)
+
+	var files struct {
+		Count   int64
+		Trashed int64
+		Bytes   int64
+	}
+	err := db.Raw("SELECT COALESCE(SUM(deleted_at IS NULL), 0) AS count, COALESCE(SUM(deleted_at IS NOT NULL), 0) AS trashed, " +
+		"COALESCE(SUM(LENGTH(content)), 0) AS bytes FROM files").Scan(&files).Error
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(filesDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(filesDesc, prometheus.GaugeValue, float64(files.Count))
+	ch <- prometheus.MustNewConstMetric(trashFilesDesc, prometheus.GaugeValue, float64(files.Trashed))
+	ch <- prometheus.MustNewConstMetric(storedBytesDesc, prometheus.GaugeValue, float64(files.Bytes), "files")
+
+	var revisionBytes int64
+	err = db.Raw("SELECT COALESCE(SUM(LENGTH(content)), 0) FROM file_revisions").Scan(&revisionBytes).Error
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(storedBytesDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(storedBytesDesc, prometheus.GaugeValue, float64(revisionBytes), "file_revisions")
+}
@@ -2,6 +2,8 @@ package server
 
 import (
     "time"
+
+    "gorm.io/gorm"
 )
 
 type File struct {
@@ -11,6 +13,37 @@ type File struct {
     Content    string    `gorm:"type:text;not null"`
     CreatedAt  time.Time `gorm:"type:datetime"`
     UpdatedAt  time.Time `gorm:"type:datetime"`
+    // DeletedAt is set when the file is moved to the trash. Queries skip
+    // trashed files unless they are made with Unscoped.
+    DeletedAt  gorm.DeletedAt `gorm:"type:datetime;index"`
 }
 
+// FileRevision keeps every version of a file's content. Revisions are
+// numbered from 1 for each file.
+type FileRevision struct {
+    ID         int       `gorm:"primaryKey;autoIncrement"`
+    FileID     int       `gorm:"not null;uniqueIndex:idx_file_revision"`
+    Revision   int       `gorm:"not null;uniqueIndex:idx_file_revision"`
+    HashDigest string    `gorm:"type:varchar(256)"`
+    Content    string    `gorm:"type:text;not null"`
+    CreatedAt  time.Time `gorm:"type:datetime"`
+}
 
+// AuditEntry records a change to the stored files: who made it, from where
+// and in which request. Entries are only ever added.
+type AuditEntry struct {
+    ID        int       `gorm:"primaryKey;autoIncrement"`
+    CreatedAt time.Time `gorm:"type:datetime(6);not null;index"`
+    // Actor is the user of the client certificate, or anonymous
+    Actor     string    `gorm:"type:varchar(255);not null;index"`
+    // Action is create, update, delete, restore or purge
+    Action    string    `gorm:"type:varchar(32);not null;index"`
+    FileID    int       `gorm:"not null;index"`
+    FileName  string    `gorm:"type:varchar(255);not null;index"`
+    // OldHash is empty for created and restored files, NewHash for
+    // deleted and purged ones
+    OldHash   string    `gorm:"type:varchar(256)"`
+    NewHash   string    `gorm:"type:varchar(256)"`
+    ClientIP  string    `gorm:"type:varchar(64)"`
+    RequestID string    `gorm:"type:varchar(64);index"`
+}
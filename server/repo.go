@@ -3,49 +3,89 @@ package server
 import (
 	"errors"
 	"fmt"
-	"os"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
-	"github.com/joho/godotenv"
+	"gorm.io/gorm/clause"
 )
 
 
+var (
+	ErrFileNotFound     = errors.New("file not found")
+	ErrRevisionNotFound = errors.New("revision not found")
+	// ErrContentChanged is returned by UpdateFileIfUnchanged when the file
+	// was changed after it was read
+	ErrContentChanged = errors.New("file changed since it was read")
+)
 
-func ConnectToDatabase() (*gorm.DB, error) {
-	// Load .env file
-	if err := godotenv.Load(); err != nil {
-		return nil, fmt.Errorf("Error loading .env file: %v", err)
-	}
-
-	// Read environment variables
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbName := os.Getenv("DB_NAME")
-
+// ConnectToDatabase opens the MySQL database and applies the pool settings
+func ConnectToDatabase(cfg DatabaseConfig) (*gorm.DB, error) {
 	// Construct the DSN (Data Source Name)
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		dbUser, dbPassword, dbHost, dbPort, dbName)
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+		cfg.User, cfg.Password, net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)), cfg.Name)
 
 	// Connect to the database using GORM
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		Logger: gormLogger{slowThreshold: slowQueryThreshold},
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to the database: %v", err)
 	}
+	if err := db.Use(Tracing{}); err != nil {
+		return nil, err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+	}
 
 	return db, nil
 }
 
-func CreateFile(db *gorm.DB, file File) error {
-	fmt.Printf(file.Name)
-	// Create the new file record
-	if err := db.Create(&file).Error; err != nil {
+// CloseDatabase closes the connections of the pool
+func CloseDatabase(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
 		return err
 	}
-	return nil
+	return sqlDB.Close()
+}
+
+// models are the tables used by the server
+func models() []any {
+	return []any{&File{}, &FileRevision{}, &AuditEntry{}}
+}
+
+// Migrate creates or updates the tables used by the server
+func Migrate(db *gorm.DB) error {
+	return db.AutoMigrate(models()...)
+}
+
+func CreateFile(db *gorm.DB, file File) error {
+	// Create the new file record together with its first revision
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&file).Error; err != nil {
+			return err
+		}
+		if err := addRevision(tx, &file); err != nil {
+			return err
+		}
+		return addAuditEntry(tx, ActionCreate, &file, "", file.HashDigest)
+	})
 }
 
 func GetFiles(db *gorm.DB) ([]File, error) {
@@ -59,37 +99,145 @@ func GetFiles(db *gorm.DB) ([]File, error) {
 }
 
 func DeleteFile(db *gorm.DB, key string) (error) {
-	var file File
+	return deleteFilesWhere(db, "hash_digest = ?", key)
+}
 
-	result := db.Where("hash_digest = ?", key).Delete(&file)
-	if result.Error != nil {
-        return result.Error
-    }
+// DeleteFileByName moves the file with the given name to the trash
+func DeleteFileByName(db *gorm.DB, name string) error {
+	return deleteFilesWhere(db, "name = ?", name)
+}
 
-    if result.RowsAffected == 0 {
-        return fmt.Errorf("file not found")
-    }
+// deleteFilesWhere moves the matching files to the trash. Their revisions
+// are kept, so that restored files have their history.
+func deleteFilesWhere(db *gorm.DB, query string, args ...any) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var files []File
+		if err := tx.Select("id", "name", "hash_digest").Where(query, args...).Find(&files).Error; err != nil {
+			return err
+		}
+
+		if len(files) == 0 {
+			return ErrFileNotFound
+		}
 
-    return nil
+		ids := make([]int, len(files))
+		for i, file := range files {
+			ids[i] = file.ID
+			if err := addAuditEntry(tx, ActionDelete, &file, file.HashDigest, ""); err != nil {
+				return err
+			}
+		}
+		return tx.Where("id IN ?", ids).Delete(&File{}).Error
+	})
 }
 
 func GetFileByName(db *gorm.DB, name string) (*File, error) {
     var file File
     result := db.Where("name = ?", name).First(&file)
     if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-        return nil, errors.New("file not found")
+        return nil, ErrFileNotFound
     } else if result.Error != nil {
         return nil, result.Error
     }
     return &file, nil
 }
 
+// UpdateFile saves file and records its new content as a revision
 func UpdateFile(db *gorm.DB, file *File) error {
-	if err := db.Save(&file).Error; err != nil {
-        return err
-    }
+	return updateFile(db, file, "")
+}
+
+// UpdateFileIfUnchanged saves file like UpdateFile, but only when the stored
+// content still has the hash baseHash, so that changes computed from an
+// older content are not lost. Otherwise it returns ErrContentChanged.
+func UpdateFileIfUnchanged(db *gorm.DB, file *File, baseHash string) error {
+	return updateFile(db, file, baseHash)
+}
+
+func updateFile(db *gorm.DB, file *File, baseHash string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// The row stays locked until the transaction ends, so concurrent
+		// updates of the file see each other's content
+		var oldHashes []string
+		err := tx.Model(&File{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", file.ID).Pluck("hash_digest", &oldHashes).Error
+		if err != nil {
+			return err
+		}
+		if len(oldHashes) == 0 {
+			return ErrFileNotFound
+		}
+		if baseHash != "" && oldHashes[0] != baseHash {
+			return ErrContentChanged
+		}
+
+		var count int64
+		if err := tx.Model(&FileRevision{}).Where("file_id = ?", file.ID).Count(&count).Error; err != nil {
+			return err
+		}
+
+		// Files stored before revisions were tracked have no history yet,
+		// keep their current content as the first revision
+		if count == 0 {
+			var previous File
+			if err := tx.First(&previous, file.ID).Error; err != nil {
+				return err
+			}
+			if err := addRevision(tx, &previous); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Save(file).Error; err != nil {
+			return err
+		}
+		if err := addRevision(tx, file); err != nil {
+			return err
+		}
+		return addAuditEntry(tx, ActionUpdate, file, oldHashes[0], file.HashDigest)
+	})
+}
+
+func addRevision(tx *gorm.DB, file *File) error {
+	var latest int
+	err := tx.Model(&FileRevision{}).
+		Where("file_id = ?", file.ID).
+		Select("COALESCE(MAX(revision), 0)").
+		Scan(&latest).Error
+	if err != nil {
+		return err
+	}
+
+	revision := FileRevision{
+		FileID:     file.ID,
+		Revision:   latest + 1,
+		HashDigest: file.HashDigest,
+		Content:    file.Content,
+		CreatedAt:  file.UpdatedAt,
+	}
+	return tx.Create(&revision).Error
+}
+
+// GetRevisions returns the revisions of a file, oldest first
+func GetRevisions(db *gorm.DB, fileID int) ([]FileRevision, error) {
+	var revisions []FileRevision
 
-    return nil
+	result := db.Where("file_id = ?", fileID).Order("revision").Find(&revisions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return revisions, nil
+}
+
+func GetRevision(db *gorm.DB, fileID int, revision int) (*FileRevision, error) {
+	var fileRevision FileRevision
+	result := db.Where("file_id = ? AND revision = ?", fileID, revision).First(&fileRevision)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrRevisionNotFound
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return &fileRevision, nil
 }
 
 func CheckDuplicateHash(db *gorm.DB, hashDigest string) error {
@@ -99,19 +247,21 @@ func CheckDuplicateHash(db *gorm.DB, hashDigest string) error {
     if result.Error != nil {
         if result.Error == gorm.ErrRecordNotFound {
             // If no record is found, it's not a duplicate, return nil
+            dedupChecks.WithLabelValues("miss").Inc()
             return nil
         }
         // If there is any other error, return it
         return result.Error
     }
     // If the file is found, it's a duplicate, return an error
+    dedupChecks.WithLabelValues("hit").Inc()
     return fmt.Errorf("file with hash_digest %s already exists", hashDigest)
 }
 
 func FetchContentAllFile(db *gorm.DB) (string, error) {
 	var contents []string
 
-	err := db.Raw("SELECT content FROM files").Scan(&contents).Error
+	err := db.Raw("SELECT content FROM files WHERE deleted_at IS NULL").Scan(&contents).Error
 	if err != nil {
 		return "", fmt.Errorf("Error executing query: %v", err)
 	}
@@ -120,4 +270,14 @@ func FetchContentAllFile(db *gorm.DB) (string, error) {
 	}
 	joinedContents := strings.Join(contents, " ")
 	return joinedContents, nil
-}
\ No newline at end of file
+}
+
+func GetFilesByNames(db *gorm.DB, names []string) ([]File, error) {
+	var files []File
+
+	result := db.Where("name IN ?", names).Find(&files)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return files, nil
+}
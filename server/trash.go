@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrRestoreConflict is returned when a trashed file can not be restored
+// because a stored file has its name or its content
+var ErrRestoreConflict = errors.New("a stored file has the same name or content")
+
+// GetTrash returns the files in the trash, most recently deleted first
+func GetTrash(db *gorm.DB) ([]File, error) {
+	var files []File
+	err := db.Unscoped().Where("deleted_at IS NOT NULL").Order("deleted_at DESC, id DESC").Find(&files).Error
+	return files, err
+}
+
+// RestoreFile takes the file with the given name out of the trash. When
+// the name was deleted several times, the latest file is restored.
+func RestoreFile(db *gorm.DB, name string) (*File, error) {
+	var file File
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("name = ? AND deleted_at IS NOT NULL", name).
+			Order("deleted_at DESC, id DESC").First(&file).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrFileNotFound
+		} else if err != nil {
+			return err
+		}
+
+		// Uploads of the same content are refused, and a second file with
+		// the name would hide one of them from name lookups
+		var count int64
+		err = tx.Model(&File{}).Where("name = ? OR hash_digest = ?", file.Name, file.HashDigest).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrRestoreConflict
+		}
+
+		if err := tx.Unscoped().Model(&file).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		return addAuditEntry(tx, ActionRestore, &file, "", file.HashDigest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	file.DeletedAt = gorm.DeletedAt{}
+	return &file, nil
+}
+
+// PurgeTrash removes for good the trashed files deleted before the given
+// time, or all of them when it is zero, together with their revisions.
+// When names are given only the files with those names are removed. It
+// returns the number of files removed.
+func PurgeTrash(db *gorm.DB, deletedBefore time.Time, names ...string) (int, error) {
+	var purged int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Unscoped().Select("id", "name", "hash_digest").Where("deleted_at IS NOT NULL")
+		if !deletedBefore.IsZero() {
+			query = query.Where("deleted_at < ?", deletedBefore)
+		}
+		if len(names) > 0 {
+			query = query.Where("name IN ?", names)
+		}
+		var files []File
+		if err := query.Find(&files).Error; err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return nil
+		}
+
+		ids := make([]int, len(files))
+		for i, file := range files {
+			ids[i] = file.ID
+			if err := addAuditEntry(tx, ActionPurge, &file, file.HashDigest, ""); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("file_id IN ?", ids).Delete(&FileRevision{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("id IN ?", ids).Delete(&File{}).Error; err != nil {
+			return err
+		}
+		purged = len(files)
+		return nil
+	})
+	return purged, err
+}
+
+// PurgeExpiredTrash removes the files that have been in the trash for
+// longer than retention. The removals are audited as made by SystemActor.
+func PurgeExpiredTrash(db *gorm.DB, retention time.Duration) (int, error) {
+	ctx := ContextWithClient(db.Statement.Context, Client{User: SystemActor})
+	return PurgeTrash(db.WithContext(ctx), time.Now().Add(-retention))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"file_storage_server/server"
+	"gorm.io/gorm"
+)
+
+// Average silent reading speed used for the reading time estimate
+const wordsPerMinute = 200
+
+type TextStats struct {
+	Name               string  `json:"name,omitempty"`
+	Lines              int     `json:"lines"`
+	Words              int     `json:"words"`
+	Characters         int     `json:"characters"`
+	Bytes              int     `json:"bytes"`
+	AverageWordLength  float64 `json:"average_word_length"`
+	UniqueWords        int     `json:"unique_words"`
+	VocabularyRichness float64 `json:"vocabulary_richness"`
+	ReadingTimeSeconds int     `json:"reading_time_seconds"`
+}
+
+type StatsResponse struct {
+	Files []TextStats `json:"files"`
+	Total TextStats   `json:"total"`
+}
+
+// statsCounter accumulates statistics for one or more texts. Lines, words,
+// characters and bytes follow `wc -lwmc`: lines are newline characters,
+// words are runs of non-space characters. Unique words are compared case
+// insensitively with surrounding punctuation removed.
+type statsCounter struct {
+	lines       int
+	words       int
+	characters  int
+	bytes       int
+	wordLetters int
+	vocabulary  map[string]struct{}
+}
+
+func newStatsCounter() *statsCounter {
+	return &statsCounter{vocabulary: make(map[string]struct{})}
+}
+
+func (c *statsCounter) add(content string) {
+	c.lines += strings.Count(content, "\n")
+	c.characters += utf8.RuneCountInString(content)
+	c.bytes += len(content)
+
+	for _, word := range strings.Fields(content) {
+		c.words++
+		c.wordLetters += utf8.RuneCountInString(word)
+
+		normalized := strings.ToLower(strings.TrimFunc(word, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}))
+		if normalized != "" {
+			c.vocabulary[normalized] = struct{}{}
+		}
+	}
+}
+
+func (c *statsCounter) stats(name string) TextStats {
+	stats := TextStats{
+		Name:        name,
+		Lines:       c.lines,
+		Words:       c.words,
+		Characters:  c.characters,
+		Bytes:       c.bytes,
+		UniqueWords: len(c.vocabulary),
+	}
+	if c.words > 0 {
+		stats.AverageWordLength = round2(float64(c.wordLetters) / float64(c.words))
+		stats.VocabularyRichness = round2(float64(len(c.vocabulary)) / float64(c.words))
+		stats.ReadingTimeSeconds = int(math.Ceil(float64(c.words) * 60 / wordsPerMinute))
+	}
+	return stats
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// computeStats returns statistics for each file, sorted by name, together
+// with the statistics of all files taken as a whole
+func computeStats(files []server.File) StatsResponse {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	response := StatsResponse{Files: []TextStats{}}
+	total := newStatsCounter()
+
+	for _, file := range files {
+		counter := newStatsCounter()
+		counter.add(file.Content)
+		total.add(file.Content)
+		response.Files = append(response.Files, counter.stats(file.Name))
+	}
+	response.Total = total.stats("")
+
+	return response
+}
+
+// Fetch text statistics for every file or the files named in the query
+func getStats(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	var files []server.File
+	var err error
+
+	if names := r.URL.Query()["file"]; len(names) > 0 {
+		files, err = server.GetFilesByNames(db, names)
+	} else {
+		files, err = server.GetFiles(db)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching files: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(computeStats(files))
+}
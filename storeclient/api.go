@@ -0,0 +1,623 @@
+package storeclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSearchStopped is returned by Grep when the server stops a search
+// before it completes, usually because it timed out
+var ErrSearchStopped = errors.New("search stopped")
+
+type FileInfo struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	HashDigest string    `json:"hash_digest"`
+	Bytes      int       `json:"bytes"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type WordCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+type TextStats struct {
+	Name               string  `json:"name,omitempty"`
+	Lines              int     `json:"lines"`
+	Words              int     `json:"words"`
+	Characters         int     `json:"characters"`
+	Bytes              int     `json:"bytes"`
+	AverageWordLength  float64 `json:"average_word_length"`
+	UniqueWords        int     `json:"unique_words"`
+	VocabularyRichness float64 `json:"vocabulary_richness"`
+	ReadingTimeSeconds int     `json:"reading_time_seconds"`
+}
+
+type Stats struct {
+	Files []TextStats `json:"files"`
+	Total TextStats   `json:"total"`
+}
+
+type Revision struct {
+	Revision   int       `json:"revision"`
+	HashDigest string    `json:"hash_digest"`
+	Bytes      int       `json:"bytes"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Health is the readiness of the server and the result of each of its
+// dependency checks
+type Health struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// Ready reports whether every check passed
+func (h *Health) Ready() bool {
+	return h.Status == "ok"
+}
+
+type HealthCheck struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// TrashedFile is a deleted file kept in the trash. PurgeAt is when the
+// server removes it for good, nil when it keeps it until the trash is
+// emptied.
+type TrashedFile struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	HashDigest string     `json:"hash_digest"`
+	Bytes      int        `json:"bytes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DeletedAt  time.Time  `json:"deleted_at"`
+	PurgeAt    *time.Time `json:"purge_at,omitempty"`
+}
+
+// AuditEntry is a change to a stored file. OldHash is empty for created
+// and restored files and NewHash for deleted and purged ones.
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	FileID    int       `json:"file_id"`
+	Name      string    `json:"name"`
+	OldHash   string    `json:"old_hash"`
+	NewHash   string    `json:"new_hash"`
+	ClientIP  string    `json:"client_ip"`
+	RequestID string    `json:"request_id"`
+}
+
+// Upload is a file sent to the server
+type Upload struct {
+	Name    string
+	Content io.Reader
+}
+
+// Ping checks that the server is up
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.get(ctx, "/ping", nil)
+	return err
+}
+
+// Ready checks the dependencies of the server. A server that is not ready
+// returns a Health whose checks tell why, and no error. The request is not
+// retried, since an unavailable server is an answer.
+func (c *Client) Ready(ctx context.Context) (*Health, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/readyz", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, newAPIError(req, resp)
+	}
+	defer resp.Body.Close()
+
+	var health Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, fmt.Errorf("storeclient: decoding readiness: %w", err)
+	}
+	return &health, nil
+}
+
+// List returns every stored file
+func (c *Client) List(ctx context.Context) ([]FileInfo, error) {
+	body, err := c.get(ctx, "/list", url.Values{"format": {"json"}})
+	if err != nil {
+		return nil, err
+	}
+
+	var files []FileInfo
+	if err := json.Unmarshal(body, &files); err != nil {
+		return nil, fmt.Errorf("storeclient: decoding file list: %w", err)
+	}
+	return files, nil
+}
+
+// Add stores new files. The server rejects files whose content is already
+// stored.
+func (c *Client) Add(ctx context.Context, uploads ...Upload) error {
+	return c.upload(ctx, http.MethodPost, "/add", uploads)
+}
+
+// Update replaces the content of the stored file with the same name, or
+// stores it as a new file
+func (c *Client) Update(ctx context.Context, upload Upload) error {
+	return c.upload(ctx, http.MethodPut, "/update", []Upload{upload})
+}
+
+// Delete moves the stored files with the same content as upload to the
+// trash, from where Restore brings them back
+func (c *Client) Delete(ctx context.Context, upload Upload) error {
+	return c.upload(ctx, http.MethodDelete, "/delete", []Upload{upload})
+}
+
+// DeleteByName moves the stored file with the given name to the trash
+func (c *Client) DeleteByName(ctx context.Context, name string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/delete", url.Values{"name": {name}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Download writes the content of a stored file to w and returns its hash.
+// The content is streamed, so w sees it as it arrives.
+func (c *Client) Download(ctx context.Context, name string, w io.Writer) (string, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/download", url.Values{"name": {name}}, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return "", fmt.Errorf("storeclient: downloading %s: %w", name, err)
+	}
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+// upload sends the files as a multipart form. The form is written to the
+// request through a pipe while it is sent, so files are never held in
+// memory.
+func (c *Client) upload(ctx context.Context, method string, path string, uploads []Upload) error {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(writeForm(writer, uploads))
+	}()
+
+	req, err := c.newRequest(ctx, method, path, nil, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.do(req)
+	// Stop the writer when the request failed before the form was read
+	pr.CloseWithError(errUploadAborted)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+var errUploadAborted = errors.New("storeclient: upload aborted")
+
+func writeForm(writer *multipart.Writer, uploads []Upload) error {
+	for _, upload := range uploads {
+		part, err := writer.CreateFormFile("files", upload.Name)
+		if err != nil {
+			return fmt.Errorf("storeclient: creating form file for %s: %w", upload.Name, err)
+		}
+		if _, err := io.Copy(part, upload.Content); err != nil {
+			return fmt.Errorf("storeclient: reading %s: %w", upload.Name, err)
+		}
+	}
+	return writer.Close()
+}
+
+var wordCountPattern = regexp.MustCompile(`(\d+) words`)
+
+// WordCount returns the number of words in all stored files
+func (c *Client) WordCount(ctx context.Context) (int, error) {
+	body, err := c.get(ctx, "/wc", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	match := wordCountPattern.FindSubmatch(body)
+	if match == nil {
+		return 0, fmt.Errorf("storeclient: unexpected word count response %q", body)
+	}
+	return strconv.Atoi(string(match[1]))
+}
+
+type FrequentWordsOptions struct {
+	// Limit is the number of words to return, 5 when 0
+	Limit  int
+	Offset int
+	// Ascending returns the least frequent words first
+	Ascending bool
+}
+
+// FrequentWords returns the most frequent words of all stored files, or
+// the least frequent ones with Ascending. Words with the same count are
+// ordered alphabetically.
+func (c *Client) FrequentWords(ctx context.Context, opts FrequentWordsOptions) ([]WordCount, error) {
+	query := url.Values{"format": {"json"}, "order": {"desc"}}
+	if opts.Ascending {
+		query.Set("order", "asc")
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		query.Set("offset", strconv.Itoa(opts.Offset))
+	}
+
+	body, err := c.get(ctx, "/fw", query)
+	if err != nil {
+		return nil, err
+	}
+
+	var words []WordCount
+	if err := json.Unmarshal(body, &words); err != nil {
+		return nil, fmt.Errorf("storeclient: decoding frequent words: %w", err)
+	}
+	return words, nil
+}
+
+type GrepOptions struct {
+	// Pattern is a Go regular expression
+	Pattern    string
+	IgnoreCase bool
+	// Before and After are the lines of context around each match
+	Before int
+	After  int
+	// MaxCount stops the search after this many matches, 0 for no limit
+	MaxCount int
+	// Timeout is the time the server may spend searching, the server
+	// default is used when 0
+	Timeout time.Duration
+	// Files limits the search to these files
+	Files []string
+	// Include limits the search to files matching this glob
+	Include string
+}
+
+// GrepLine is one line of grep output
+type GrepLine struct {
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+	Text string `json:"text,omitempty"`
+	// Match is false for context lines
+	Match bool `json:"match,omitempty"`
+	// Separator marks the "--" between groups of non-adjacent lines. The
+	// other fields are empty.
+	Separator bool `json:"separator,omitempty"`
+	// Error is set by the server when it stops the search early
+	Error string `json:"error,omitempty"`
+}
+
+// String formats the line like grep does
+func (l GrepLine) String() string {
+	if l.Separator {
+		return "--"
+	}
+	sep := "-"
+	if l.Match {
+		sep = ":"
+	}
+	return fmt.Sprintf("%s%s%d%s%s", l.File, sep, l.Line, sep, l.Text)
+}
+
+// Grep searches the stored files and calls fn for every line of output as
+// it arrives. Returning an error from fn stops the search.
+func (c *Client) Grep(ctx context.Context, opts GrepOptions, fn func(GrepLine) error) error {
+	query := url.Values{"pattern": {opts.Pattern}, "format": {"json"}}
+	if opts.IgnoreCase {
+		query.Set("ignore_case", "true")
+	}
+	if opts.Before > 0 {
+		query.Set("before", strconv.Itoa(opts.Before))
+	}
+	if opts.After > 0 {
+		query.Set("after", strconv.Itoa(opts.After))
+	}
+	if opts.MaxCount > 0 {
+		query.Set("max", strconv.Itoa(opts.MaxCount))
+	}
+	if opts.Timeout > 0 {
+		query.Set("timeout", opts.Timeout.String())
+	}
+	if opts.Include != "" {
+		query.Set("include", opts.Include)
+	}
+	for _, name := range opts.Files {
+		query.Add("file", name)
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/grep", query, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The server writes one JSON object per line as matches are found
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var line GrepLine
+		if err := decoder.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("storeclient: decoding grep output: %w", err)
+		}
+
+		if line.Error != "" {
+			return fmt.Errorf("%w: %s", ErrSearchStopped, line.Error)
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
+
+// Stats returns text statistics for the named files, or for every file
+// when no names are given
+func (c *Client) Stats(ctx context.Context, names ...string) (*Stats, error) {
+	query := url.Values{}
+	for _, name := range names {
+		query.Add("file", name)
+	}
+
+	body, err := c.get(ctx, "/stats", query)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return nil, fmt.Errorf("storeclient: decoding stats: %w", err)
+	}
+	return &stats, nil
+}
+
+type DiffOptions struct {
+	A string
+	// RevA is the revision of A to compare, the current content when 0
+	RevA int
+	// B defaults to A, to compare two revisions of the same file
+	B    string
+	RevB int
+	// Words produces a word level diff instead of a unified diff
+	Words bool
+	// Context is the number of unchanged lines around changes, the server
+	// default of 3 when 0. Use a negative value for no context.
+	Context int
+}
+
+// Diff returns the difference between two files or two revisions of a
+// file. It is empty when they are equal.
+func (c *Client) Diff(ctx context.Context, opts DiffOptions) (string, error) {
+	query := url.Values{"a": {opts.A}}
+	if opts.B != "" {
+		query.Set("b", opts.B)
+	}
+	if opts.RevA > 0 {
+		query.Set("rev_a", strconv.Itoa(opts.RevA))
+	}
+	if opts.RevB > 0 {
+		query.Set("rev_b", strconv.Itoa(opts.RevB))
+	}
+	if opts.Words {
+		query.Set("mode", "word")
+	}
+	if opts.Context > 0 {
+		query.Set("context", strconv.Itoa(opts.Context))
+	} else if opts.Context < 0 {
+		query.Set("context", "0")
+	}
+
+	body, err := c.get(ctx, "/diff", query)
+	return string(body), err
+}
+
+// History returns the revisions of a file, oldest first
+func (c *Client) History(ctx context.Context, name string) ([]Revision, error) {
+	body, err := c.get(ctx, "/history", url.Values{"name": {name}})
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+	if err := json.Unmarshal(body, &revisions); err != nil {
+		return nil, fmt.Errorf("storeclient: decoding history: %w", err)
+	}
+	return revisions, nil
+}
+
+// Patch applies a unified diff to a stored file and returns the new hash of
+// its content. When base is not empty the patch is only applied if the
+// current content has that hash. Patches that do not apply cleanly return
+// ErrConflict.
+func (c *Client) Patch(ctx context.Context, name string, diff io.Reader, base string) (string, error) {
+	query := url.Values{"op": {"diff"}}
+	if base != "" {
+		query.Set("base", base)
+	}
+	return c.patch(ctx, name, query, diff)
+}
+
+// Append adds data to the end of a stored file and returns the new hash of
+// its content
+func (c *Client) Append(ctx context.Context, name string, data io.Reader) (string, error) {
+	return c.patch(ctx, name, url.Values{"op": {"append"}}, data)
+}
+
+// PatchRange replaces length bytes at offset of a stored file with data.
+// base must be the hash of the current content.
+func (c *Client) PatchRange(ctx context.Context, name string, offset int, length int, data io.Reader, base string) (string, error) {
+	query := url.Values{
+		"op":     {"range"},
+		"offset": {strconv.Itoa(offset)},
+		"length": {strconv.Itoa(length)},
+		"base":   {base},
+	}
+	return c.patch(ctx, name, query, data)
+}
+
+func (c *Client) patch(ctx context.Context, name string, query url.Values, data io.Reader) (string, error) {
+	query.Set("name", name)
+
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, data); err != nil {
+		return "", fmt.Errorf("storeclient: reading patch: %w", err)
+	}
+
+	resp, _, err := c.send(ctx, http.MethodPatch, "/patch", query, "text/plain; charset=utf-8", &body)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+// AuditOptions filters the audit log. Empty fields match every entry.
+type AuditOptions struct {
+	Actor string
+	// Action is create, update, delete, restore or purge
+	Action string
+	Name   string
+	FileID int
+	Since  time.Time
+	Until  time.Time
+	// Limit is the number of entries to return, 100 when 0
+	Limit  int
+	Offset int
+}
+
+// Audit returns the changes made to stored files, newest first
+func (c *Client) Audit(ctx context.Context, opts AuditOptions) ([]AuditEntry, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{"actor": opts.Actor, "action": opts.Action, "name": opts.Name} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if opts.FileID > 0 {
+		query.Set("file_id", strconv.Itoa(opts.FileID))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339))
+	}
+	if !opts.Until.IsZero() {
+		query.Set("until", opts.Until.Format(time.RFC3339))
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		query.Set("offset", strconv.Itoa(opts.Offset))
+	}
+
+	body, err := c.get(ctx, "/audit", query)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []AuditEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("storeclient: decoding audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// Trash lists the deleted files kept by the server, most recently deleted
+// first
+func (c *Client) Trash(ctx context.Context) ([]TrashedFile, error) {
+	body, err := c.get(ctx, "/trash", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []TrashedFile
+	if err := json.Unmarshal(body, &files); err != nil {
+		return nil, fmt.Errorf("storeclient: decoding trash: %w", err)
+	}
+	return files, nil
+}
+
+// Restore takes the file with the given name out of the trash. It returns
+// ErrNotFound when no such file is in the trash and ErrConflict when a
+// stored file has the same name or content.
+func (c *Client) Restore(ctx context.Context, name string) error {
+	req, err := c.newRequest(ctx, http.MethodPost, "/trash/restore", url.Values{"name": {name}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// EmptyTrash removes the files in the trash for good, only the ones with
+// the given names when there are any, and returns how many were removed
+func (c *Client) EmptyTrash(ctx context.Context, names ...string) (int, error) {
+	query := url.Values{}
+	if len(names) > 0 {
+		query["name"] = names
+	}
+	req, err := c.newRequest(ctx, http.MethodDelete, "/trash", query, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("storeclient: decoding purge result: %w", err)
+	}
+	return result.Purged, nil
+}
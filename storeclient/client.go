@@ -0,0 +1,389 @@
+// Package storeclient is a Go client for the file storage server.
+//
+//	client, err := storeclient.New("http://localhost:2021", storeclient.WithToken(token))
+//	if err != nil {
+//		return err
+//	}
+//	files, err := client.List(ctx)
+//
+// Every method takes a context and returns typed results. Requests that the
+// server rejects return an *APIError, which can be matched against
+// ErrBadRequest, ErrNotFound, ErrConflict and the other sentinel errors with
+// errors.Is.
+//
+// Requests carry the W3C trace context of their context, through the
+// propagator set with otel.SetTextMapPropagator, so that the spans of the
+// server are part of the caller's traces.
+package storeclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// maxRetryWait is the longest wait between two attempts. A server asking to
+// wait longer with Retry-After is not retried.
+const maxRetryWait = 30 * time.Second
+
+var (
+	ErrBadRequest      = errors.New("bad request")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrNotFound        = errors.New("not found")
+	ErrConflict        = errors.New("conflict")
+	ErrInvalidPatch    = errors.New("invalid patch")
+	ErrTooManyRequests = errors.New("too many requests")
+	ErrServer          = errors.New("server error")
+	// ErrTimeout is returned when the server does not answer in the time
+	// set with WithTimeout
+	ErrTimeout = errors.New("timeout waiting for the server")
+)
+
+// APIError is returned when the server answers with a non-2xx status
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	// Message is the body of the response, which the server uses for
+	// error messages
+	Message string
+	// RetryAfter is the wait asked for by the server with a Retry-After
+	// header, 0 when there was none
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+	}
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.Path, e.Status, e.Message)
+}
+
+// Is matches the error against the sentinel error for its status code
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrInvalidPatch:
+		return e.StatusCode == http.StatusUnprocessableEntity
+	case ErrTooManyRequests:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// Client talks to a file storage server. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	token      string
+	timeout    time.Duration
+	retries    int
+	retryWait  time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used to send requests. The default
+// is http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTLSConfig sets the TLS settings used for https servers, e.g. a
+// custom CA pool or a client certificate. It replaces the http.Client set
+// with WithHTTPClient by one with its own transport.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *Client) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		c.httpClient = &http.Client{Transport: transport}
+	}
+}
+
+// WithToken sends token as a bearer token with every request
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithTimeout limits how long every attempt of a request waits for the
+// server: to connect, and to answer once the request has been sent. The
+// time spent streaming request and response bodies is not limited, so
+// large files are not cut off. Attempts that time out fail with ErrTimeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries retries requests that do not modify anything up to retries
+// times when the server cannot be reached, times out or answers with a 5xx
+// or 429 status. The wait between attempts starts at wait and doubles every
+// time, with random jitter so that many clients do not retry at once. A
+// Retry-After header sent by the server replaces the wait.
+func WithRetries(retries int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryWait = wait
+	}
+}
+
+// New returns a client for the server at baseURL, e.g.
+// "http://localhost:2021"
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("storeclient: invalid server URL %q: %w", baseURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("storeclient: invalid server URL %q: scheme must be http or https", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		retryWait:  100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// BaseURL returns the URL of the server
+func (c *Client) BaseURL() string {
+	return c.baseURL.String()
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *c.baseURL
+	u.Path += path
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	// Requests made within a span continue its trace on the server, when
+	// the program has set up the W3C trace context propagator
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, nil
+}
+
+// do sends req and returns the response when its status is 2xx. Other
+// statuses are returned as *APIError. GET and HEAD requests are retried as
+// configured with WithRetries. The caller must close the response body.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	retries := c.retries
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		retries = 0
+	}
+
+	ctx := req.Context()
+	wait := c.retryWait
+	for attempt := 0; ; attempt++ {
+		resp, err := c.roundTrip(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		if err == nil {
+			err = newAPIError(req, resp)
+		}
+		if attempt >= retries || !retryable(ctx, err) {
+			return nil, err
+		}
+
+		delay := jitter(wait)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			if apiErr.RetryAfter > maxRetryWait {
+				return nil, err
+			}
+			delay = apiErr.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		wait = min(wait*2, maxRetryWait)
+	}
+}
+
+// roundTrip sends one attempt of req, limited by the timeout set with
+// WithTimeout. The timer is stopped while the request body is written and
+// once the response starts, and the attempt's context lives until the
+// response body is closed.
+func (c *Client) roundTrip(req *http.Request) (*http.Response, error) {
+	if c.timeout <= 0 {
+		return c.httpClient.Do(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(c.timeout, func() { cancel(ErrTimeout) })
+	var mu sync.Mutex
+	answered := false
+	trace := &httptrace.ClientTrace{
+		WroteHeaders: func() {
+			timer.Stop()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			// The server may answer before it has read the whole body
+			if !answered {
+				timer.Reset(c.timeout)
+			}
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			answered = true
+			timer.Stop()
+		},
+	}
+
+	resp, err := c.httpClient.Do(req.Clone(httptrace.WithClientTrace(ctx, trace)))
+	if err != nil {
+		timer.Stop()
+		cause := context.Cause(ctx)
+		cancel(nil)
+		if errors.Is(cause, ErrTimeout) {
+			return nil, fmt.Errorf("%s %s: %w after %s", req.Method, req.URL.Path, ErrTimeout, c.timeout)
+		}
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: func() {
+		timer.Stop()
+		cancel(nil)
+	}}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// jitter returns a random wait between half of wait and wait
+func jitter(wait time.Duration) time.Duration {
+	if wait <= 1 {
+		return wait
+	}
+	return wait/2 + time.Duration(rand.Int64N(int64(wait/2)+1))
+}
+
+func newAPIError(req *http.Request, resp *http.Response) *APIError {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &APIError{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    strings.TrimSpace(string(body)),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	// Network errors
+	return true
+}
+
+// get sends a GET request and returns the whole response body
+func (c *Client) get(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// send sends a request with a body and returns the whole response
+func (c *Client) send(ctx context.Context, method string, path string, query url.Values, contentType string, body *bytes.Buffer) (*http.Response, []byte, error) {
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	return resp, responseBody, err
+}
@@ -0,0 +1,315 @@
+package storeclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewInvalidURL(t *testing.T) {
+	_, err := New("localhost:2021")
+	assert.Error(t, err)
+
+	client, err := New("http://localhost:2021/")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:2021", client.BaseURL())
+}
+
+func TestAPIErrorIs(t *testing.T) {
+	tests := []struct {
+		status int
+		target error
+	}{
+		{http.StatusBadRequest, ErrBadRequest},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusConflict, ErrConflict},
+		{http.StatusUnprocessableEntity, ErrInvalidPatch},
+		{http.StatusTooManyRequests, ErrTooManyRequests},
+		{http.StatusBadGateway, ErrServer},
+	}
+
+	for _, test := range tests {
+		var err error = &APIError{Method: "GET", Path: "/list", StatusCode: test.status}
+		assert.ErrorIs(t, fmt.Errorf("wrapped: %w", err), test.target, "status %d", test.status)
+		assert.False(t, errors.Is(err, ErrSearchStopped))
+	}
+	assert.False(t, errors.Is(&APIError{StatusCode: http.StatusNotFound}, ErrConflict))
+}
+
+func TestRetries(t *testing.T) {
+	var attempts atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "pong working!")
+	}))
+	defer mockServer.Close()
+
+	client, err := New(mockServer.URL, WithRetries(2, time.Millisecond))
+	assert.NoError(t, err)
+	assert.NoError(t, client.Ping(context.Background()))
+	assert.Equal(t, int32(3), attempts.Load())
+
+	// Requests that modify files are not retried
+	attempts.Store(0)
+	_, err = client.Append(context.Background(), "a.txt", strings.NewReader("x"))
+	assert.ErrorIs(t, err, ErrServer)
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestWithToken(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `[{"id":1,"name":"a.txt","bytes":3}]`)
+	}))
+	defer mockServer.Close()
+
+	client, _ := New(mockServer.URL, WithToken("secret"))
+	files, err := client.List(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []FileInfo{{ID: 1, Name: "a.txt", Bytes: 3}}, files)
+
+	client, _ = New(mockServer.URL)
+	_, err = client.List(context.Background())
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestGrep(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("format") != "json" || query.Get("pattern") != "b" || query.Get("max") != "2" {
+			http.Error(w, "Invalid query", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, `{"file":"my-file-2-x.txt","line":1,"text":"a","match":false}`)
+		fmt.Fprintln(w, `{"file":"my-file-2-x.txt","line":2,"text":"b","match":true}`)
+		fmt.Fprintln(w, `{"separator":true}`)
+		fmt.Fprintln(w, `{"error":"search stopped after 10s: context deadline exceeded"}`)
+	}))
+	defer mockServer.Close()
+
+	client, _ := New(mockServer.URL)
+	var lines []string
+	err := client.Grep(context.Background(), GrepOptions{Pattern: "b", MaxCount: 2}, func(line GrepLine) error {
+		lines = append(lines, line.String())
+		return nil
+	})
+
+	assert.ErrorIs(t, err, ErrSearchStopped)
+	assert.Equal(t, []string{"my-file-2-x.txt-1-a", "my-file-2-x.txt:2:b", "--"}, lines)
+}
+
+func TestPatch(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Method != http.MethodPatch || query.Get("name") != "a.txt" || query.Get("op") != "diff" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if query.Get("base") != "abc" {
+			http.Error(w, "Base hash does not match", http.StatusConflict)
+			return
+		}
+		w.Header().Set("ETag", `"def"`)
+		fmt.Fprintln(w, "File patched successfully, new hash def")
+	}))
+	defer mockServer.Close()
+
+	client, _ := New(mockServer.URL)
+	hash, err := client.Patch(context.Background(), "a.txt", strings.NewReader("@@ -1 +1 @@\n-a\n+b\n"), "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "def", hash)
+
+	_, err = client.Patch(context.Background(), "a.txt", strings.NewReader(""), "old")
+	assert.ErrorIs(t, err, ErrConflict)
+	var apiErr *APIError
+	assert.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, "Base hash does not match", apiErr.Message)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("disk error")
+}
+
+func TestUploadStreamsFiles(t *testing.T) {
+	var received []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, header := range r.MultipartForm.File["files"] {
+			received = append(received, header.Filename)
+		}
+	}))
+	defer mockServer.Close()
+
+	client, _ := New(mockServer.URL)
+	err := client.Add(context.Background(),
+		Upload{Name: "a.txt", Content: strings.NewReader("a")},
+		Upload{Name: "b.txt", Content: strings.NewReader(strings.Repeat("b", 1<<16))})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, received)
+
+	// Errors reading a file abort the request
+	err = client.Update(context.Background(), Upload{Name: "c.txt", Content: failingReader{}})
+	assert.ErrorContains(t, err, "disk error")
+}
+
+func TestDownload(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") != "a.txt" {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		fmt.Fprint(w, "content")
+	}))
+	defer mockServer.Close()
+
+	client, _ := New(mockServer.URL)
+	var content strings.Builder
+	hash, err := client.Download(context.Background(), "a.txt", &content)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", hash)
+	assert.Equal(t, "content", content.String())
+
+	_, err = client.Download(context.Background(), "b.txt", &content)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, 2*time.Second, parseRetryAfter("2", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Wed, 01 May 2024 10:01:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Wed, 01 May 2024 09:00:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+
+	var attempts atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "Slow down", http.StatusTooManyRequests)
+	}))
+	defer mockServer.Close()
+
+	// Waits longer than the maximum are not retried
+	client, _ := New(mockServer.URL, WithRetries(3, time.Millisecond))
+	err := client.Ping(context.Background())
+	assert.ErrorIs(t, err, ErrTooManyRequests)
+	var apiErr *APIError
+	assert.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, time.Hour, apiErr.RetryAfter)
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		wait := jitter(time.Second)
+		assert.GreaterOrEqual(t, wait, 500*time.Millisecond)
+		assert.LessOrEqual(t, wait, time.Second)
+	}
+}
+
+// slowReader returns one byte at a time with a pause before each
+type slowReader struct {
+	n     int
+	pause time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.pause)
+	r.n--
+	b[0] = 'x'
+	return 1, nil
+}
+
+func TestTimeout(t *testing.T) {
+	var attempts atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			attempts.Add(1)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("ETag", `"abc"`)
+	}))
+	defer mockServer.Close()
+
+	client, _ := New(mockServer.URL, WithTimeout(50*time.Millisecond), WithRetries(1, time.Millisecond))
+	start := time.Now()
+	err := client.Ping(context.Background())
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, int32(2), attempts.Load())
+
+	// Sending a body slower than the timeout is not a timeout
+	hash, err := client.Append(context.Background(), "a.txt", &slowReader{n: 4, pause: 30 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", hash)
+}
+
+func TestCancel(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer mockServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	client, _ := New(mockServer.URL, WithTimeout(time.Minute), WithRetries(3, time.Millisecond))
+	_, err := client.List(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTraceContext(t *testing.T) {
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Ping(context.Background()))
+	assert.Empty(t, traceparent)
+
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+	assert.NoError(t, client.Ping(ctx))
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceparent)
+}
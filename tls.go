@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"file_storage_server/server"
+)
+
+// certReloader serves a certificate and key pair from files and loads them
+// again when either file changes. A pair that fails to load is logged and
+// the previous one is kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	modified, err := cr.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.load(modified); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// lastModified returns the latest modification time of the two files
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Error reading TLS certificate: %v", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) load(modified time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading TLS certificate: %v", err)
+	}
+	cr.cert = &cert
+	cr.modified = modified
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. The files are
+// checked on every handshake, which costs two stat calls.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	modified, err := cr.lastModified()
+	if err == nil && !modified.Equal(cr.modified) {
+		err = cr.load(modified)
+		if err == nil {
+			slog.Info("reloaded TLS certificate", "file", cr.certFile)
+		}
+	}
+	if err != nil {
+		slog.Error("keeping the previous TLS certificate", "error", err)
+	}
+	return cr.cert, nil
+}
+
+// newTLSConfig returns the TLS settings of the server, or nil when TLS is
+// not enabled
+func newTLSConfig(cfg server.TLSConfig) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	switch cfg.ClientAuth {
+	case server.ClientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case server.ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client CA file: %v", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Error reading client CA file: no certificates in %s", cfg.ClientCAFile)
+	}
+	return tlsConfig, nil
+}
+
+// authenticateClients maps the verified client certificate of a request to
+// a user, see server.TLSConfig.ClientUsers. Requests with a certificate
+// that is not mapped are refused.
+func authenticateClients(next http.Handler, users map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		user := name
+		if len(users) > 0 {
+			var ok bool
+			if user, ok = users[name]; !ok {
+				http.Error(w, fmt.Sprintf("Certificate %q is not allowed", name), http.StatusForbidden)
+				return
+			}
+		}
+		ctx, info := withRequestInfo(r.Context())
+		info.user = user
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
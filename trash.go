@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"file_storage_server/server"
+	"gorm.io/gorm"
+)
+
+// trashPurgeInterval is how often files kept longer than trash.retention
+// are purged
+const trashPurgeInterval = time.Hour
+
+type TrashedFileInfo struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	HashDigest string    `json:"hash_digest"`
+	Bytes      int       `json:"bytes"`
+	CreatedAt  time.Time `json:"created_at"`
+	DeletedAt  time.Time `json:"deleted_at"`
+	// PurgeAt is when the file is removed for good, unset when the trash
+	// is kept until it is emptied
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// List the files in the trash with GET, or remove them for good with
+// DELETE. DELETE removes every trashed file, or only the ones named by the
+// 'name' parameters.
+func trash(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		getTrash(w, r, db)
+	case http.MethodDelete:
+		purged, err := server.PurgeTrash(db, time.Time{}, r.URL.Query()["name"]...)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error emptying the trash: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PurgeResult{Purged: purged})
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getTrash(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	files, err := server.GetTrash(db)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching the trash: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	infos := []TrashedFileInfo{}
+	for _, file := range files {
+		info := TrashedFileInfo{
+			ID:         file.ID,
+			Name:       file.Name,
+			HashDigest: file.HashDigest,
+			Bytes:      len(file.Content),
+			CreatedAt:  file.CreatedAt,
+			DeletedAt:  file.DeletedAt.Time,
+		}
+		if config.Trash.Retention > 0 {
+			purgeAt := file.DeletedAt.Time.Add(time.Duration(config.Trash.Retention))
+			info.PurgeAt = &purgeAt
+		}
+		infos = append(infos, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// Take the file named by the 'name' parameter out of the trash. It answers
+// 409 when a stored file has the same name or content.
+func restoreFile(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := server.RestoreFile(db, name); err != nil {
+		switch {
+		case errors.Is(err, server.ErrFileNotFound):
+			http.Error(w, fmt.Sprintf("File %s is not in the trash", name), http.StatusNotFound)
+		case errors.Is(err, server.ErrRestoreConflict):
+			http.Error(w, fmt.Sprintf("Can not restore %s: %v", name, err), http.StatusConflict)
+		default:
+			http.Error(w, fmt.Sprintf("Error restoring file: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	fmt.Fprintln(w, "File restored successfully")
+}
+
+// purgeTrash removes the files kept in the trash for longer than retention
+// every trashPurgeInterval, until ctx is done
+func purgeTrash(ctx context.Context, db *gorm.DB, retention time.Duration) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := server.PurgeExpiredTrash(db.WithContext(ctx), retention)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("cannot purge the trash", "error", err)
+		} else if purged > 0 {
+			slog.Info("purged the trash", "files", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}